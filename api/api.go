@@ -33,11 +33,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/internal/analytics"
 	"github.com/googlegenomics/htsget/internal/bam"
 	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/cram"
 	"github.com/googlegenomics/htsget/internal/genomics"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/googleapi"
@@ -45,10 +47,19 @@ import (
 )
 
 const (
-	readsPath = "/reads/"
-	blockPath = "/block/"
+	readsPath    = "/reads/"
+	variantsPath = "/variants/"
+	tabixPath    = "/tabix/"
+	blockPath    = "/block/"
+
+	// Ticket URLs are annotated with the part of the file they cover.
+	classHeader = "header"
+	classBody   = "body"
 
 	eofMarkerDataURL = "data:;base64,H4sIBAAAAAAA/wYAQkMCABsAAwAAAAAAAAAAAA=="
+
+	// The reference name that selects the unplaced unmapped reads.
+	unmappedReferenceName = "*"
 )
 
 var (
@@ -56,26 +67,36 @@ var (
 	errNoFormatSpecified      = errors.New("no format specified")
 	errMissingReferenceName   = errors.New("no reference name specified")
 	errMissingOrInvalidToken  = errors.New("missing or invalid token")
+	errUnmappedRange          = errors.New("start and end cannot be specified for unplaced unmapped reads")
 )
 
-// NewStorageClientFunc is the type of function that constructs the appropriate
-// storage.Client to satisfy the incoming request. Any headers that caused this
-// particular client to be created are returned to allow block requests to be
-// generated correctly.
-type NewStorageClientFunc func(*http.Request) (*storage.Client, http.Header, error)
-
 // Server provides an htsget protocol server.  Must be created with NewServer.
 type Server struct {
-	newStorageClient NewStorageClientFunc
-	blockSizeLimit   uint64
-	whitelist        map[string]bool
+	newStorage     NewStorageFunc
+	blockSizeLimit uint64
+	whitelist      map[string]bool
+	serviceInfo    ServiceInfo
+	resolver       IDResolver
+	indexCache     *lruCache
+	signer         *urlSigner
+	ticketLifetime time.Duration
+	directURLs     bool
 }
 
-// NewServer returns a new Server configured to use newStorageClient and
-// blockSizeLimit. The server will call storageClientFunc on each request to
-// determine which GCS storage client to use.
-func NewServer(newStorageClient NewStorageClientFunc, blockSizeLimit uint64) *Server {
-	return &Server{newStorageClient, blockSizeLimit, make(map[string]bool)}
+// NewServer returns a new Server configured to use newStorage and
+// blockSizeLimit. The server will call newStorage on each request to determine
+// which storage backend to use.
+func NewServer(newStorage NewStorageFunc, blockSizeLimit uint64) *Server {
+	return &Server{
+		newStorage:     newStorage,
+		blockSizeLimit: blockSizeLimit,
+		whitelist:      make(map[string]bool),
+		serviceInfo:    defaultServiceInfo,
+		resolver:       pathResolver{},
+		indexCache:     newLRUCache(defaultIndexCacheSize),
+		signer:         newRandomSigner(),
+		ticketLifetime: defaultTicketLifetime,
+	}
 }
 
 // Whitelist adds buckets to the set of buckets which the server is allowed to
@@ -87,12 +108,56 @@ func (server *Server) Whitelist(buckets []string) {
 	}
 }
 
-// Export registers the htsget API endpoint with mux and reads data using gcs.
+// SetIDResolver configures the server to use resolver to find the data
+// identified by the IDs in requests.  By default, IDs are interpreted as
+// "bucket/object" paths.
+func (server *Server) SetIDResolver(resolver IDResolver) {
+	server.resolver = resolver
+}
+
+// SetIndexCacheSize sets the approximate number of bytes of memory that are
+// used to cache parsed indexes.  Setting the size to zero disables the cache.
+func (server *Server) SetIndexCacheSize(size int64) {
+	server.indexCache.resize(size)
+}
+
+// SetSigningKey sets the key used to sign the block URLs returned in tickets.
+// By default, a random key is generated when the server is created, so block
+// URLs can only be fetched from the same server process.  Servers that share
+// traffic must be configured with the same key.
+func (server *Server) SetSigningKey(key []byte) {
+	server.signer = &urlSigner{key}
+}
+
+// SetTicketLifetime sets the length of time for which the block URLs returned
+// in tickets can be fetched.  The default is one hour.
+func (server *Server) SetTicketLifetime(lifetime time.Duration) {
+	server.ticketLifetime = lifetime
+}
+
+// EnableDirectURLs configures the server to send clients directly to the
+// storage backend (if it supports it) to read the parts of the data that are
+// returned unchanged, using range requests.  Only the blocks at the edges of
+// each chunk, which have to be re-encoded, are then fetched from the server.
+// Clients must be able to read from the storage backend for this to work.
+func (server *Server) EnableDirectURLs() {
+	server.directURLs = true
+}
+
+// Export registers the htsget API endpoint with mux.
 // Blocks returned from the endpoint will generally not exceed blockSizeLimit
-// bytes, though BAM chunks that already exceed this size will not be split.
+// bytes.  Larger chunks are split at the records recorded in the index, so a
+// block may only exceed the limit if the index has no records inside it (as
+// for the unplaced unmapped reads) or if the data is a CRAM file.
 func (server *Server) Export(mux *http.ServeMux) {
 	mux.Handle(readsPath, forwardOrigin(server.serveReads))
+	mux.Handle(variantsPath, forwardOrigin(server.serveVariants))
+	mux.Handle(tabixPath, forwardOrigin(server.serveTabix))
 	mux.Handle(blockPath, forwardOrigin(server.serveBlocks))
+	mux.Handle("/"+serviceInfoPath, forwardOrigin(server.serveServiceInfo(readsInfo)))
+	mux.Handle(readsPath+serviceInfoPath, forwardOrigin(server.serveServiceInfo(readsInfo)))
+	mux.Handle(variantsPath+serviceInfoPath, forwardOrigin(server.serveServiceInfo(variantsInfo)))
+	mux.Handle(tabixPath+serviceInfoPath, forwardOrigin(server.serveServiceInfo(tabixInfo)))
 }
 
 func (server *Server) serveReads(w http.ResponseWriter, req *http.Request) {
@@ -101,135 +166,358 @@ func (server *Server) serveReads(w http.ResponseWriter, req *http.Request) {
 	track := analytics.TrackerFromContext(ctx)
 	track(analytics.Event("Reads", "Reads Request Received", "", nil))
 
-	query := req.URL.Query()
-	if err := parseFormat(query.Get("format")); err != nil {
+	params, err := parseTicketRequest(req)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing request", err))
+		return
+	}
+
+	format, err := parseFormat(params.Format, "BAM", "CRAM")
+	if err != nil {
 		writeError(w, newUnsupportedFormatError(err))
 		return
 	}
 
-	bucket, object, err := parseID(req.URL.Path[len(readsPath):])
+	projection, err := newProjection(params.Fields, params.Tags, params.NoTags)
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing readset ID", err))
+		writeError(w, newInvalidInputError("parsing fields", err))
 		return
 	}
+	// CRAM records are not decoded, so every field is returned.
+	if format == "CRAM" {
+		projection = nil
+	}
 
-	if err := server.checkWhitelist(bucket); err != nil {
-		writeError(w, newPermissionDeniedError("checking whitelist", err))
+	id := req.URL.Path[len(readsPath):]
+	dataset, err := server.resolve(id)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	gcs, headers, err := server.newStorageClient(req)
+	store, headers, err := server.newStorage(req)
 	if err != nil {
 		writeError(w, newStorageError("creating client", err))
 		return
 	}
 
-	data, err := gcs.Bucket(bucket).Object(object).NewRangeReader(ctx, 0, int64(server.blockSizeLimit))
+	getReferenceID := bam.GetReferenceID
+	if format == "CRAM" {
+		getReferenceID = cram.GetReferenceID
+	}
+	dataObject, generation, err := pinGeneration(ctx, store.Object(dataset.Data.Bucket, dataset.Data.Object))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	resolve := referenceResolver(ctx, dataObject, server.blockSizeLimit, getReferenceID)
+	regions, err := resolveRegions(params.Regions, func(name string) (int32, error) {
+		if name == unmappedReferenceName {
+			return genomics.UnmappedReferenceID, nil
+		}
+		return resolve(name)
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var chunks []*bgzf.Chunk
+	var boundaries []bgzf.Address
+	eof := eofMarkerDataURL
+	if format == "CRAM" {
+		request := &cramRequest{
+			dataObject:     dataObject,
+			indexObjects:   objects(store, dataset.indexLocations(".cram", ".crai")),
+			blockSizeLimit: server.blockSizeLimit,
+			regions:        regions,
+		}
+		chunks, eof, err = request.handle(ctx)
+	} else {
+		request := &readsRequest{
+			dataObject:     dataObject,
+			store:          store,
+			indexes:        dataset.indexLocations(".bam", ".bai", ".csi"),
+			indexCache:     server.indexCache,
+			blockSizeLimit: server.blockSizeLimit,
+			regions:        regions,
+		}
+		chunks, err = request.handle(ctx)
+		boundaries = request.boundaries
+	}
+	if err != nil {
+		track(analytics.Event("Reads", "Reads Internal Error", "", nil))
+		writeError(w, err)
+		return
+	}
+
+	query := make(url.Values)
+	if projection != nil {
+		query = projection.values()
+	}
+	if format == "BAM" {
+		if trimmed := trimRegions(regions); trimmed != nil {
+			encoded, err := encodeRawQuery(trimmed)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			query.Set("regions", encoded)
+		}
+	}
+
+	// The records must all be rewritten to apply a projection.
+	var direct Object
+	if server.directURLs && projection == nil {
+		direct = dataObject
+	}
+	urls, err := server.ticketURLs(req, id, generation, direct, boundaries, chunks, eof, params.Class, query, headers)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"htsget": map[string]interface{}{
+			"format": format,
+			"urls":   urls,
+		}})
+
+	count := int64(len(urls))
+	track(analytics.Event("Reads", "Reads Response URL Count", "", &count))
+	track(analytics.Event("Reads", "Reads Response Sent", "", nil))
+}
+
+func (server *Server) serveVariants(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	track := analytics.TrackerFromContext(ctx)
+	track(analytics.Event("Variants", "Variants Request Received", "", nil))
+
+	params, err := parseTicketRequest(req)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing request", err))
+		return
+	}
+
+	format, err := parseFormat(params.Format, "VCF", "BCF")
+	if err != nil {
+		writeError(w, newUnsupportedFormatError(err))
+		return
+	}
+
+	id := req.URL.Path[len(variantsPath):]
+	dataset, err := server.resolve(id)
 	if err != nil {
-		writeError(w, newStorageError("opening data", err))
+		writeError(w, err)
 		return
 	}
-	defer data.Close()
 
-	region, err := parseRegion(query, data)
+	store, headers, err := server.newStorage(req)
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing region", err))
+		writeError(w, newStorageError("creating client", err))
 		return
 	}
 
-	if region.End > 0 && region.Start > region.End {
-		writeError(w, newInvalidRangeError(fmt.Errorf("%s: start > end", region)))
+	// BCF files can only be indexed using CSI, while bgzipped VCF files may
+	// have either a tabix or a CSI index (a tabix index is preferred).
+	extension := ".vcf.gz"
+	if format == "BCF" {
+		extension = ".bcf"
+	}
+	var tabixIndexes, csiIndexes []Location
+	for _, index := range dataset.indexLocations(extension, ".tbi", ".csi") {
+		if !strings.HasSuffix(index.Object, ".tbi") {
+			csiIndexes = append(csiIndexes, index)
+		} else if format == "VCF" {
+			tabixIndexes = append(tabixIndexes, index)
+		}
+	}
+
+	dataObject, generation, err := pinGeneration(ctx, store.Object(dataset.Data.Bucket, dataset.Data.Object))
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	request := &readsRequest{
-		indexObjects: []*storage.ObjectHandle{gcs.Bucket(bucket).Object(object + ".bai"),
-			gcs.Bucket(bucket).Object(strings.TrimSuffix(object, ".bam") + ".bai"),
-		},
+	request := &variantsRequest{
+		format:         format,
+		dataObject:     dataObject,
+		store:          store,
+		indexes:        append(tabixIndexes, csiIndexes...),
+		indexCache:     server.indexCache,
 		blockSizeLimit: server.blockSizeLimit,
-		region:         region,
+		regions:        params.Regions,
 	}
 
 	chunks, err := request.handle(ctx)
 	if err != nil {
-		track(analytics.Event("Reads", "Reads Internal Error", "", nil))
+		track(analytics.Event("Variants", "Variants Internal Error", "", nil))
 		writeError(w, err)
 		return
 	}
 
-	var base string
-	if req.Host != "" {
-		if req.TLS != nil {
-			base = "https://"
-		} else {
-			base = "http://"
-		}
-		base += req.Host
+	var direct Object
+	if server.directURLs {
+		direct = dataObject
+	}
+	urls, err := server.ticketURLs(req, id, generation, direct, nil, chunks, eofMarkerDataURL, params.Class, nil, headers)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	base += strings.Replace(req.URL.Path, readsPath, blockPath, 1)
 
-	var urls []map[string]interface{}
-	for _, chunk := range chunks {
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(chunk); err != nil {
-			writeError(w, fmt.Errorf("encoding chunk: %v", err))
-			return
-		}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"htsget": map[string]interface{}{
+			"format": format,
+			"urls":   urls,
+		}})
 
-		url := map[string]interface{}{
-			"url": fmt.Sprintf("%s?%s", base, base64.URLEncoding.EncodeToString(buf.Bytes())),
-		}
-		if len(headers) > 0 {
-			// The htsget specification does not support multiple values for a single
-			// header.
-			flattened := make(map[string]string)
-			for k, v := range headers {
-				flattened[k] = v[0]
-			}
-			url["headers"] = flattened
-		}
-		urls = append(urls, url)
+	count := int64(len(urls))
+	track(analytics.Event("Variants", "Variants Response URL Count", "", &count))
+	track(analytics.Event("Variants", "Variants Response Sent", "", nil))
+}
+
+// serveTabix serves tickets for bgzipped text files with a tabix index.  This
+// is an extension to the htsget protocol, which only defines reads and
+// variants endpoints.
+func (server *Server) serveTabix(w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+
+	track := analytics.TrackerFromContext(ctx)
+	track(analytics.Event("Tabix", "Tabix Request Received", "", nil))
+
+	params, err := parseTicketRequest(req)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing request", err))
+		return
+	}
+
+	format, err := parseFormat(params.Format, "TABIX")
+	if err != nil {
+		writeError(w, newUnsupportedFormatError(err))
+		return
+	}
+
+	id := req.URL.Path[len(tabixPath):]
+	dataset, err := server.resolve(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	store, headers, err := server.newStorage(req)
+	if err != nil {
+		writeError(w, newStorageError("creating client", err))
+		return
+	}
+
+	// The data is not read until the blocks are requested, but its generation
+	// is recorded so that the ticket matches the index.
+	dataObject, generation, err := pinGeneration(ctx, store.Object(dataset.Data.Bucket, dataset.Data.Object))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	request := &tabixRequest{
+		store:          store,
+		indexes:        dataset.indexLocations(".gz", ".tbi"),
+		indexCache:     server.indexCache,
+		blockSizeLimit: server.blockSizeLimit,
+		regions:        params.Regions,
+	}
+
+	chunks, err := request.handle(ctx)
+	if err != nil {
+		track(analytics.Event("Tabix", "Tabix Internal Error", "", nil))
+		writeError(w, err)
+		return
+	}
+
+	var direct Object
+	if server.directURLs {
+		direct = dataObject
+	}
+	urls, err := server.ticketURLs(req, id, generation, direct, nil, chunks, eofMarkerDataURL, params.Class, nil, headers)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	urls = append(urls, map[string]interface{}{"url": eofMarkerDataURL})
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"htsget": map[string]interface{}{
-			"format": "BAM",
+			"format": format,
 			"urls":   urls,
 		}})
 
 	count := int64(len(urls))
-	track(analytics.Event("Reads", "Reads Response URL Count", "", &count))
-	track(analytics.Event("Reads", "Reads Response Sent", "", nil))
+	track(analytics.Event("Tabix", "Tabix Response URL Count", "", &count))
+	track(analytics.Event("Tabix", "Tabix Response Sent", "", nil))
 }
 
 func (server *Server) serveBlocks(w http.ResponseWriter, req *http.Request) {
-	bucket, object, err := parseID(req.URL.Path[len(blockPath):])
+	id := req.URL.Path[len(blockPath):]
+	verified, err := server.signer.verify(blockPath+id, req.URL.RawQuery, time.Now())
 	if err != nil {
-		writeError(w, newInvalidInputError("parsing readset ID", err))
+		writeError(w, err)
 		return
 	}
 
-	if err := server.checkWhitelist(bucket); err != nil {
-		writeError(w, newPermissionDeniedError("checking whitelist", err))
+	dataset, err := server.resolve(id)
+	if err != nil {
+		writeError(w, err)
 		return
 	}
 
-	var chunk bgzf.Chunk
-	if err := decodeRawQuery(req.URL.RawQuery, &chunk); err != nil {
-		writeError(w, fmt.Errorf("decoding raw query: %v", err))
+	// The encoded chunk may be followed by parameters that control how the
+	// records in the chunk are returned.
+	rawChunk, rawQuery := verified, ""
+	if i := strings.IndexByte(rawChunk, '&'); i >= 0 {
+		rawChunk, rawQuery = rawChunk[:i], rawChunk[i+1:]
+	}
+
+	chunk, generation, err := decodeChunk(rawChunk)
+	if err != nil {
+		writeError(w, newInvalidInputError("decoding chunk", err))
 		return
 	}
 
-	gcs, _, err := server.newStorageClient(req)
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing query", err))
+		return
+	}
+	projection, err := parseProjection(query)
+	if err != nil {
+		writeError(w, newInvalidInputError("parsing projection", err))
+		return
+	}
+	var regions []genomics.Region
+	if encoded := query.Get("regions"); encoded != "" {
+		if err := decodeRawQuery(encoded, &regions); err != nil {
+			writeError(w, newInvalidInputError("decoding regions", err))
+			return
+		}
+	}
+
+	store, _, err := server.newStorage(req)
 	if err != nil {
 		writeError(w, fmt.Errorf("creating storage client: %v", err))
 		return
 	}
 
+	// The addresses in the chunk are only valid for the generation of the
+	// object from which the ticket was created.
+	object := store.Object(dataset.Data.Bucket, dataset.Data.Object)
+	if generation != "" {
+		object = object.IfGenerationMatch(generation)
+	}
+
 	request := &blockRequest{
-		object: gcs.Bucket(bucket).Object(object),
-		chunk:  chunk,
+		object:  object,
+		chunk:   chunk,
+		regions: regions,
 	}
 
 	response, err := request.handle(req.Context())
@@ -237,6 +525,9 @@ func (server *Server) serveBlocks(w http.ResponseWriter, req *http.Request) {
 		writeError(w, err)
 		return
 	}
+	if projection != nil {
+		response = projection.filter(response)
+	}
 	defer response.Close()
 
 	w.Header().Add("Content-type", "application/octet-stream")
@@ -247,6 +538,52 @@ func (server *Server) serveBlocks(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// resolve returns the dataset identified by id after checking that the server
+// is allowed to read each of its objects.
+func (server *Server) resolve(id string) (*Dataset, error) {
+	dataset, err := server.resolver.Resolve(id)
+	if err != nil {
+		switch err {
+		case errInvalidOrUnspecifiedID:
+			return nil, newInvalidInputError("parsing ID", err)
+		case ErrUnknownID:
+			return nil, newNotFoundError("resolving ID", err)
+		}
+		return nil, fmt.Errorf("resolving ID: %v", err)
+	}
+
+	for _, location := range append([]Location{dataset.Data}, dataset.Indexes...) {
+		if err := server.checkWhitelist(location.Bucket); err != nil {
+			return nil, newPermissionDeniedError("checking whitelist", err)
+		}
+	}
+	return dataset, nil
+}
+
+// pinGeneration returns a handle to object that can only read its current
+// generation, so that the data cannot change while it is being read, along
+// with the generation.  If the storage backend does not report a generation,
+// object is returned unchanged with an empty generation.
+func pinGeneration(ctx context.Context, object Object) (Object, string, error) {
+	attrs, err := object.Attrs(ctx)
+	if err != nil {
+		return nil, "", newStorageError("reading data attributes", err)
+	}
+	if attrs.Generation == "" {
+		return object, "", nil
+	}
+	return object.IfGenerationMatch(attrs.Generation), attrs.Generation, nil
+}
+
+// objects returns handles to the objects at each of locations.
+func objects(store Storage, locations []Location) []Object {
+	var objects []Object
+	for _, location := range locations {
+		objects = append(objects, store.Object(location.Bucket, location.Object))
+	}
+	return objects
+}
+
 func (server *Server) checkWhitelist(bucket string) error {
 	if len(server.whitelist) == 0 || server.whitelist[bucket] {
 		return nil
@@ -254,6 +591,174 @@ func (server *Server) checkWhitelist(bucket string) error {
 	return fmt.Errorf("access to bucket %s is not allowed", bucket)
 }
 
+// ticketURLs returns the URL entries of a ticket for the object identified by
+// id, which must have the given generation (if not empty).  The first of
+// chunks must cover the header of the object and the rest its body.  The eof
+// URL is appended to terminate the data.  If class is classHeader, the body
+// chunks are left out of the ticket.  Any query parameters (which control how
+// the records are returned) are added to the URLs of the body chunks.  If
+// data is not nil, the whole blocks of each chunk are read directly from it
+// where possible, using the sorted record addresses in boundaries (if any) to
+// keep the records of trimmed chunks on the server.
+func (server *Server) ticketURLs(req *http.Request, id, generation string, data Object, boundaries []bgzf.Address, chunks []*bgzf.Chunk, eof, class string, query url.Values, headers http.Header) ([]map[string]interface{}, error) {
+	urls, err := server.blockURLs(req, id, generation, data, boundaries, chunks[:1], classHeader, nil, headers)
+	if err != nil {
+		return nil, err
+	}
+	if class == classHeader {
+		return append(urls, map[string]interface{}{"url": eof, "class": classHeader}), nil
+	}
+
+	body, err := server.blockURLs(req, id, generation, data, boundaries, chunks[1:], classBody, query, headers)
+	if err != nil {
+		return nil, err
+	}
+	urls = append(urls, body...)
+	return append(urls, map[string]interface{}{"url": eof, "class": classBody}), nil
+}
+
+// blockURLs returns the ticket URL entries that fetch each of chunks from the
+// object identified by id.  If generation is not empty, the blocks can only
+// be fetched while the object has that generation.  Each entry is annotated
+// with class and any query parameters are appended to the encoded chunk.  Any
+// headers are added to each entry so that the block requests are authorized
+// in the same way as the original request.  The URLs are signed so that they
+// cannot be altered and expire after the ticket lifetime of the server.
+//
+// If data is a DirectObject, the whole blocks in the middle of each chunk are
+// read by the client directly from storage using a range request, and only
+// the partial blocks at either end are fetched from the server.  If the
+// records are trimmed to regions, the first and last blocks are always
+// fetched from the server so that their records can be trimmed.  Since the
+// server can only trim records from a known record address, the last blocks
+// are fetched from the last of the sorted record addresses in boundaries that
+// precedes them, and chunks without such an address are not split.
+func (server *Server) blockURLs(req *http.Request, id, generation string, data Object, boundaries []bgzf.Address, chunks []*bgzf.Chunk, class string, query url.Values, headers http.Header) ([]map[string]interface{}, error) {
+	var base string
+	if req.Host != "" {
+		if req.TLS != nil {
+			base = "https://"
+		} else {
+			base = "http://"
+		}
+		base += req.Host
+	}
+	path := blockPath + id
+	expires := time.Now().Add(server.ticketLifetime)
+
+	blockURL := func(chunk *bgzf.Chunk, query url.Values) map[string]interface{} {
+		var suffix string
+		if len(query) > 0 {
+			suffix = "&" + query.Encode()
+		}
+		signed := server.signer.sign(path, encodeChunk(chunk, generation)+suffix, expires)
+		return urlEntry(fmt.Sprintf("%s%s?%s", base, path, signed), class, headers)
+	}
+
+	// The start of the block that holds the first trimmed record of a suffix
+	// belongs to records that started in the blocks read directly, so it is
+	// returned as it is.
+	_, trim := query["regions"]
+	untrimmed := make(url.Values)
+	for k, v := range query {
+		if k != "regions" {
+			untrimmed[k] = v
+		}
+	}
+
+	var urls []map[string]interface{}
+	direct, _ := data.(DirectObject)
+	var directURL string
+	var directHeaders http.Header
+	for _, chunk := range chunks {
+		if direct == nil {
+			urls = append(urls, blockURL(chunk, query))
+			continue
+		}
+
+		var prefix, gap, suffix *bgzf.Chunk
+		var offset, length int64
+		var err error
+		if trim {
+			prefix, gap, suffix, offset, length, err = splitTrimmedChunk(req.Context(), direct, chunk, boundaries)
+		} else {
+			prefix, suffix, offset, length, err = splitChunk(req.Context(), direct, chunk)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if length == 0 {
+			urls = append(urls, blockURL(chunk, query))
+			continue
+		}
+
+		if directURL == "" {
+			var signed bool
+			directURL, signed, err = direct.DirectURL(generation, expires)
+			if err != nil {
+				return nil, newStorageError("creating direct URL", err)
+			}
+			directHeaders = make(http.Header)
+			if !signed {
+				for k, v := range headers {
+					directHeaders[k] = v
+				}
+			}
+		}
+
+		if prefix != nil {
+			urls = append(urls, blockURL(prefix, query))
+		}
+		directHeaders.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+		urls = append(urls, urlEntry(directURL, class, directHeaders))
+		if gap != nil {
+			urls = append(urls, blockURL(gap, untrimmed))
+		}
+		if suffix != nil {
+			urls = append(urls, blockURL(suffix, query))
+		}
+	}
+	return urls, nil
+}
+
+// urlEntry returns a ticket URL entry for url annotated with class and any
+// headers.
+func urlEntry(url, class string, headers http.Header) map[string]interface{} {
+	entry := map[string]interface{}{
+		"url":   url,
+		"class": class,
+	}
+	if len(headers) > 0 {
+		// The htsget specification does not support multiple values for a single
+		// header.
+		flattened := make(map[string]string)
+		for k, v := range headers {
+			flattened[k] = v[0]
+		}
+		entry["headers"] = flattened
+	}
+	return entry
+}
+
+// mergeBody merges all but the first of chunks, which covers the header and
+// is kept apart so that it can be requested on its own.  Chunks that are
+// larger than sizeLimit are split at the sorted addresses in boundaries, at
+// which records are known to start.
+func mergeBody(chunks []*bgzf.Chunk, boundaries []bgzf.Address, sizeLimit uint64) []*bgzf.Chunk {
+	body := bgzf.Split(bgzf.Merge(chunks[1:], sizeLimit), boundaries, sizeLimit)
+	return append(chunks[:1], body...)
+}
+
+// encodeRawQuery encodes v in a form that can be used in a URL and decoded
+// using decodeRawQuery.
+func encodeRawQuery(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return "", fmt.Errorf("gob: %v", err)
+	}
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
 func decodeRawQuery(rawQuery string, v interface{}) error {
 	b, err := base64.URLEncoding.DecodeString(rawQuery)
 	if err != nil {
@@ -267,60 +772,182 @@ func decodeRawQuery(rawQuery string, v interface{}) error {
 	return nil
 }
 
-// parseID parses path and returns a GCS bucket and object, or an error.
-func parseID(path string) (string, string, error) {
-	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 {
-		if parts[0] != "" && parts[1] != "" {
-			return parts[0], parts[1], nil
+// parseFormat checks that format is one of supported and returns it.  If
+// format is empty, the first supported format is returned.
+func parseFormat(format string, supported ...string) (string, error) {
+	if format == "" {
+		return supported[0], nil
+	}
+	for _, candidate := range supported {
+		if format == candidate {
+			return format, nil
 		}
 	}
-	return "", "", errInvalidOrUnspecifiedID
+	return "", fmt.Errorf("unsupported format %q", format)
+}
+
+// ticketRequest holds the parameters of a ticket request.  It mirrors the
+// JSON body of a POST request, as defined in version 1.2 of the htsget
+// specification.
+type ticketRequest struct {
+	Format  string        `json:"format"`
+	Class   string        `json:"class"`
+	Fields  []string      `json:"fields"`
+	Tags    []string      `json:"tags"`
+	NoTags  []string      `json:"notags"`
+	Regions []queryRegion `json:"regions"`
+}
+
+// queryRegion is a region as specified by the client, before the reference
+// name has been resolved.
+type queryRegion struct {
+	ReferenceName string  `json:"referenceName"`
+	Start         *uint32 `json:"start"`
+	End           *uint32 `json:"end"`
 }
 
-func parseFormat(format string) error {
-	if format != "" && format != "BAM" {
-		return fmt.Errorf("unsupported format %q", format)
+// parseTicketRequest parses the parameters of req from its JSON body for POST
+// requests or from its query parameters otherwise.
+func parseTicketRequest(req *http.Request) (*ticketRequest, error) {
+	var params *ticketRequest
+	if req.Method == http.MethodPost {
+		params = new(ticketRequest)
+		if err := json.NewDecoder(req.Body).Decode(params); err != nil {
+			return nil, fmt.Errorf("decoding body: %v", err)
+		}
+	} else {
+		var err error
+		if params, err = parseQuery(req.URL.Query()); err != nil {
+			return nil, err
+		}
 	}
-	return nil
+
+	switch params.Class {
+	case "", classBody:
+	case classHeader:
+		if len(params.Regions) > 0 {
+			return nil, errors.New("regions cannot be specified for header requests")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported class %q", params.Class)
+	}
+	return params, nil
 }
 
-func parseRegion(query url.Values, data io.Reader) (genomics.Region, error) {
+func parseQuery(query url.Values) (*ticketRequest, error) {
+	var params ticketRequest
+	params.Format = query.Get("format")
+	params.Class = query.Get("class")
+	params.Fields = splitList(query, "fields")
+	params.Tags = splitList(query, "tags")
+	params.NoTags = splitList(query, "notags")
+
 	var (
 		name  = query.Get("referenceName")
 		start = query.Get("start")
 		end   = query.Get("end")
 	)
 	if name == "" && start == "" && end == "" {
-		return genomics.AllMappedReads, nil
-	}
-	if name == "" {
-		return genomics.Region{}, errMissingReferenceName
-	}
-
-	id, err := bam.GetReferenceID(data, name)
-	if err != nil {
-		return genomics.Region{}, fmt.Errorf("resolving reference %q: %v", name, err)
+		return &params, nil
 	}
 
-	region := genomics.Region{ReferenceID: id}
-
+	region := queryRegion{ReferenceName: name}
 	if start != "" {
 		n, err := strconv.ParseUint(start, 10, 32)
 		if err != nil {
-			return genomics.Region{}, fmt.Errorf("parsing start: %v", err)
+			return nil, fmt.Errorf("parsing start: %v", err)
 		}
-		region.Start = uint32(n)
+		v := uint32(n)
+		region.Start = &v
 	}
-
 	if end != "" {
 		n, err := strconv.ParseUint(end, 10, 32)
 		if err != nil {
-			return genomics.Region{}, fmt.Errorf("parsing end: %v", err)
+			return nil, fmt.Errorf("parsing end: %v", err)
 		}
-		region.End = uint32(n)
+		v := uint32(n)
+		region.End = &v
 	}
+	params.Regions = []queryRegion{region}
+	return &params, nil
+}
 
-	return region, nil
+// splitList returns the comma separated values of the key parameter in
+// query.  It returns nil if the parameter is missing and an empty list if it
+// is present but empty, since the two have different meanings for tags.
+func splitList(query url.Values, key string) []string {
+	if _, ok := query[key]; !ok {
+		return nil
+	}
+	if value := query.Get(key); value != "" {
+		return strings.Split(value, ",")
+	}
+	return []string{}
+}
+
+// resolveRegions uses resolve to look up the IDs of the references named in
+// regions.  If no regions are specified, all mapped reads are matched.
+func resolveRegions(regions []queryRegion, resolve func(string) (int32, error)) ([]genomics.Region, error) {
+	if len(regions) == 0 {
+		return []genomics.Region{genomics.AllMappedReads}, nil
+	}
+
+	var resolved []genomics.Region
+	for _, query := range regions {
+		if query.ReferenceName == "" {
+			return nil, newInvalidInputError("parsing region", errMissingReferenceName)
+		}
+		if query.ReferenceName == unmappedReferenceName && (query.Start != nil || query.End != nil) {
+			return nil, newInvalidInputError("parsing region", errUnmappedRange)
+		}
+
+		id, err := resolve(query.ReferenceName)
+		if err != nil {
+			if _, ok := err.(*apiError); ok {
+				return nil, err
+			}
+			return nil, newInvalidInputError("parsing region",
+				fmt.Errorf("resolving reference %q: %v", query.ReferenceName, err))
+		}
+
+		region := genomics.Region{ReferenceID: id}
+		if query.Start != nil {
+			region.Start = *query.Start
+		}
+		if query.End != nil {
+			region.End = *query.End
+		}
+		if region.End > 0 && region.Start > region.End {
+			return nil, newInvalidRangeError(fmt.Errorf("%s: start > end", region))
+		}
+		resolved = append(resolved, region)
+	}
+	return resolved, nil
+}
+
+// referenceResolver returns a function that resolves reference names by
+// calling getReferenceID with the header of object.  Results are cached so
+// that the header is read at most once for each distinct name.
+func referenceResolver(ctx context.Context, object Object, blockSizeLimit uint64, getReferenceID func(io.Reader, string) (int32, error)) func(string) (int32, error) {
+	ids := make(map[string]int32)
+	return func(name string) (int32, error) {
+		if id, ok := ids[name]; ok {
+			return id, nil
+		}
+
+		data, err := object.NewRangeReader(ctx, 0, int64(blockSizeLimit))
+		if err != nil {
+			return 0, newStorageError("opening data", err)
+		}
+		defer data.Close()
+
+		id, err := getReferenceID(data, name)
+		if err != nil {
+			return 0, err
+		}
+		ids[name] = id
+		return id, nil
+	}
 }
 
 // apiError is used to capture errors that have been defined in the API.
@@ -363,19 +990,27 @@ func newNotFoundError(context string, err error) error {
 }
 
 func newStorageError(context string, err error) error {
-	if err == errMissingOrInvalidToken {
+	if err == errMissingOrInvalidToken || err == errOutsideRoot {
 		return newPermissionDeniedError(context, err)
 	}
-	if err == storage.ErrObjectNotExist {
+	if err == ErrObjectNotExist {
 		return newNotFoundError("object does not exist", err)
 	}
-	if err, ok := err.(*googleapi.Error); ok {
-		switch err.Code {
-		case http.StatusUnauthorized:
-			return newInvalidAuthenticationError(context, err)
-		case http.StatusForbidden:
-			return newPermissionDeniedError(context, err)
-		}
+	if err == ErrGenerationMismatch {
+		return newInvalidInputError("object changed since the ticket was issued; request a new ticket", err)
+	}
+	var code int
+	switch err := err.(type) {
+	case *googleapi.Error:
+		code = err.Code
+	case *statusError:
+		code = err.code
+	}
+	switch code {
+	case http.StatusUnauthorized:
+		return newInvalidAuthenticationError(context, err)
+	case http.StatusForbidden:
+		return newPermissionDeniedError(context, err)
 	}
 	return err
 }
@@ -410,7 +1045,7 @@ var (
 	initializeDefaultStorageClient sync.Once
 )
 
-func newClientWithOptions(opts ...option.ClientOption) (*storage.Client, http.Header, error) {
+func newClientWithOptions(opts ...option.ClientOption) (Storage, http.Header, error) {
 	initializeDefaultStorageClient.Do(func() {
 		gcs, err := storage.NewClient(context.Background(), opts...)
 		if err != nil {
@@ -418,27 +1053,27 @@ func newClientWithOptions(opts ...option.ClientOption) (*storage.Client, http.He
 		}
 		defaultStorageClient = gcs
 	})
-	return defaultStorageClient, nil, nil
+	return NewGCSStorage(defaultStorageClient), nil, nil
 }
 
-// NewDefaultClient returns a storage client that uses the application default
+// NewDefaultClient returns a GCS backend that uses the application default
 // credentials.  It caches the storage client for efficiency.
-func NewDefaultClient(_ *http.Request) (*storage.Client, http.Header, error) {
+func NewDefaultClient(_ *http.Request) (Storage, http.Header, error) {
 	return newClientWithOptions()
 }
 
-// NewPublicClient returns a storage client that does not use any form of
+// NewPublicClient returns a GCS backend that does not use any form of
 // client authorization.  It can only be used to read publicly-readable
 // objects. It caches the storage client for efficiency.
-func NewPublicClient(_ *http.Request) (*storage.Client, http.Header, error) {
+func NewPublicClient(_ *http.Request) (Storage, http.Header, error) {
 	return newClientWithOptions(option.WithHTTPClient(http.DefaultClient))
 }
 
-// NewClientFromBearerToken constructs a storage client that uses the OAuth2
+// NewClientFromBearerToken constructs a GCS backend that uses the OAuth2
 // bearer token found in req to make storage requests.  It returns the
 // authorization header containing the bearer token as well to allow subsequent
 // requests to be authenticated correctly.
-func NewClientFromBearerToken(req *http.Request) (*storage.Client, http.Header, error) {
+func NewClientFromBearerToken(req *http.Request) (Storage, http.Header, error) {
 	authorization := req.Header.Get("Authorization")
 
 	fields := strings.Split(authorization, " ")
@@ -455,7 +1090,7 @@ func NewClientFromBearerToken(req *http.Request) (*storage.Client, http.Header,
 		return nil, nil, fmt.Errorf("creating client with token source: %v", err)
 	}
 
-	return client, map[string][]string{
+	return NewGCSStorage(client), map[string][]string{
 		"Authorization": []string{authorization},
 	}, nil
 }
@@ -17,20 +17,190 @@ package api
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
 
-	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
+// The prefix of the current encoding of chunks in block URLs.
+const chunkEncodingVersion = "v1"
+
+// encodeChunk returns a compact representation of chunk that can be used in a
+// URL and decoded with decodeChunk.  It consists of the encoding version and
+// the start and end virtual addresses in hexadecimal, separated by dots.  If
+// generation is not empty, the (query escaped) generation of the object
+// follows the addresses.  For example, "v1.3f2a0000.3f2a01c4" or
+// "v1.3f2a0000.3f2a01c4.1528312345678900".
+func encodeChunk(chunk *bgzf.Chunk, generation string) string {
+	encoded := fmt.Sprintf("%s.%s.%s", chunkEncodingVersion, chunk.Start, chunk.End)
+	if generation != "" {
+		encoded += "." + url.QueryEscape(generation)
+	}
+	return encoded
+}
+
+// decodeChunk decodes a chunk and object generation encoded by encodeChunk.
+// Chunks encoded as base64 gobs by older versions of the server, which never
+// contain a dot, are also accepted.
+func decodeChunk(encoded string) (bgzf.Chunk, string, error) {
+	var chunk bgzf.Chunk
+	if !strings.Contains(encoded, ".") {
+		if err := decodeRawQuery(encoded, &chunk); err != nil {
+			return chunk, "", fmt.Errorf("decoding legacy chunk: %v", err)
+		}
+		return chunk, "", checkChunk(chunk)
+	}
+
+	parts := strings.SplitN(encoded, ".", 4)
+	if parts[0] != chunkEncodingVersion {
+		return chunk, "", fmt.Errorf("unsupported chunk encoding %q", parts[0])
+	}
+	if len(parts) < 3 {
+		return chunk, "", errors.New("missing chunk addresses")
+	}
+	start, err := bgzf.ParseAddress(parts[1])
+	if err != nil {
+		return chunk, "", fmt.Errorf("parsing start address: %v", err)
+	}
+	end, err := bgzf.ParseAddress(parts[2])
+	if err != nil {
+		return chunk, "", fmt.Errorf("parsing end address: %v", err)
+	}
+	chunk.Start, chunk.End = start, end
+	if err := checkChunk(chunk); err != nil {
+		return chunk, "", err
+	}
+
+	var generation string
+	if len(parts) == 4 {
+		if generation, err = url.QueryUnescape(parts[3]); err != nil {
+			return chunk, "", fmt.Errorf("parsing generation: %v", err)
+		}
+		if generation == "" {
+			return chunk, "", errors.New("empty generation")
+		}
+	}
+	return chunk, generation, nil
+}
+
+// checkChunk returns an error if chunk ends before it starts.
+func checkChunk(chunk bgzf.Chunk) error {
+	if chunk.End < chunk.Start {
+		return fmt.Errorf("end address %s precedes start address %s", chunk.End, chunk.Start)
+	}
+	return nil
+}
+
+// splitChunk divides chunk into the partial blocks at either end, which must
+// be re-encoded by the server, and the whole blocks in between, which are
+// held in the length bytes of object starting at offset.  The prefix and
+// suffix are nil if the chunk starts or ends on a block boundary.  If there
+// are no whole blocks, length is zero and the chunk cannot be split.  Only
+// the header of the first block is read (to find where the next block
+// starts), and only if the chunk does not start on a block boundary.
+func splitChunk(ctx context.Context, object Object, chunk *bgzf.Chunk) (prefix, suffix *bgzf.Chunk, offset, length int64, err error) {
+	start, end := chunk.Start, chunk.End
+	head, tail := int64(start.BlockOffset()), int64(end.BlockOffset())
+	if head == tail {
+		return nil, nil, 0, 0, nil
+	}
+
+	if start.DataOffset() != 0 {
+		next, err := nextBlock(ctx, object, head)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		prefix = &bgzf.Chunk{Start: start, End: bgzf.NewAddress(uint64(next), 0)}
+		if head = next; head >= tail {
+			return nil, nil, 0, 0, nil
+		}
+	}
+	if end.DataOffset() != 0 {
+		suffix = &bgzf.Chunk{Start: bgzf.NewAddress(uint64(tail), 0), End: end}
+	}
+	return prefix, suffix, head, tail - head, nil
+}
+
+// splitTrimmedChunk divides chunk, whose records are trimmed by the server,
+// like splitChunk except that the records in its first and last blocks are
+// kept in the prefix and suffix.  The prefix always holds the whole of the
+// first block.  The suffix starts at the last of the sorted record addresses
+// in boundaries that is no later than the start of the block holding the end
+// of the chunk, since records can only be trimmed from a known record.  The
+// gap holds the data between the start of the block and that address, and is
+// nil if the address is at the start of a block.  If there are no whole
+// blocks between the prefix and the block holding the start of the suffix,
+// length is zero and the chunk cannot be split.
+func splitTrimmedChunk(ctx context.Context, object Object, chunk *bgzf.Chunk, boundaries []bgzf.Address) (prefix, gap, suffix *bgzf.Chunk, offset, length int64, err error) {
+	start, end := chunk.Start, chunk.End
+	limit := bgzf.NewAddress(end.BlockOffset(), 1)
+	if end < limit {
+		limit = end
+	}
+	i := sort.Search(len(boundaries), func(i int) bool {
+		return boundaries[i] >= limit
+	})
+	if i == 0 || boundaries[i-1] <= start {
+		return nil, nil, nil, 0, 0, nil
+	}
+	last := boundaries[i-1]
+
+	head, tail := int64(start.BlockOffset()), int64(last.BlockOffset())
+	if head == tail {
+		return nil, nil, nil, 0, 0, nil
+	}
+	next, err := nextBlock(ctx, object, head)
+	if err != nil {
+		return nil, nil, nil, 0, 0, err
+	}
+	if next >= tail {
+		return nil, nil, nil, 0, 0, nil
+	}
+
+	prefix = &bgzf.Chunk{Start: start, End: bgzf.NewAddress(uint64(next), 0)}
+	if last.DataOffset() != 0 {
+		gap = &bgzf.Chunk{Start: bgzf.NewAddress(uint64(tail), 0), End: last}
+	}
+	suffix = &bgzf.Chunk{Start: last, End: end}
+	return prefix, gap, suffix, next, tail - next, nil
+}
+
+// nextBlock returns the offset of the block that follows the block at offset
+// in object.  Only the header of the block is read.
+func nextBlock(ctx context.Context, object Object, offset int64) (int64, error) {
+	r, err := object.NewRangeReader(ctx, offset, bgzf.MaximumBlockSize)
+	if err != nil {
+		return 0, newStorageError("opening first block", err)
+	}
+	size, err := bgzf.ReadBlockSize(r)
+	r.Close()
+	if err != nil {
+		return 0, fmt.Errorf("reading first block: %v", err)
+	}
+	return offset + int64(size), nil
+}
+
 type blockRequest struct {
-	object *storage.ObjectHandle
+	object Object
 	chunk  bgzf.Chunk
+
+	// If regions is not empty, the chunk holds BAM records and those that do
+	// not overlap any of the regions are removed.
+	regions []genomics.Region
 }
 
 func (req *blockRequest) handle(ctx context.Context) (io.ReadCloser, error) {
+	if len(req.regions) > 0 {
+		return req.trim(ctx)
+	}
+
 	start, end := req.chunk.Start, req.chunk.End
 	head, tail := int64(start.BlockOffset()), int64(end.BlockOffset())
 
@@ -0,0 +1,180 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// The default amount of memory used to cache parsed indexes.
+	defaultIndexCacheSize = 64 * 1024 * 1024
+
+	// The number of times an index is read before giving up if it keeps being
+	// replaced while it is read.
+	maximumIndexAttempts = 3
+)
+
+// cacheKey identifies a particular generation of an object.
+type cacheKey struct {
+	location   Location
+	generation string
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	value interface{}
+	size  int64
+}
+
+// lruCache holds values up to a total size, discarding the least recently
+// used values first.  It is safe for concurrent use.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	entries  *list.List
+	elements map[cacheKey]*list.Element
+}
+
+// newLRUCache returns a cache that holds values up to a total of capacity.
+func newLRUCache(capacity int64) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		entries:  list.New(),
+		elements: make(map[cacheKey]*list.Element),
+	}
+}
+
+// get returns the value stored for key, if any.
+func (cache *lruCache) get(key cacheKey) (interface{}, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	element, ok := cache.elements[key]
+	if !ok {
+		return nil, false
+	}
+	cache.entries.MoveToFront(element)
+	return element.Value.(*cacheEntry).value, true
+}
+
+// add stores value, which has the given size, for key.  Values larger than
+// the capacity of the cache are not stored.
+func (cache *lruCache) add(key cacheKey, value interface{}, size int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if element, ok := cache.elements[key]; ok {
+		cache.remove(element)
+	}
+	if size > cache.capacity {
+		return
+	}
+	cache.elements[key] = cache.entries.PushFront(&cacheEntry{key, value, size})
+	cache.size += size
+	for cache.size > cache.capacity {
+		cache.remove(cache.entries.Back())
+	}
+}
+
+func (cache *lruCache) remove(element *list.Element) {
+	entry := cache.entries.Remove(element).(*cacheEntry)
+	delete(cache.elements, entry.key)
+	cache.size -= entry.size
+}
+
+// resize changes the capacity of the cache, discarding values as necessary.
+func (cache *lruCache) resize(capacity int64) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	cache.capacity = capacity
+	for cache.size > cache.capacity {
+		cache.remove(cache.entries.Back())
+	}
+}
+
+// readIndex uses parse to read the first of the candidate index locations
+// that exists.  Parsed indexes are cached using the generation of the object
+// so that they are only read again after they have been changed.
+func readIndex(ctx context.Context, store Storage, cache *lruCache, locations []Location, parse func(io.Reader) (interface{}, error)) (interface{}, error) {
+	err := ErrObjectNotExist
+	for _, location := range locations {
+		object := store.Object(location.Bucket, location.Object)
+		var attrs *ObjectAttrs
+		if attrs, err = object.Attrs(ctx); err != nil {
+			continue
+		}
+
+		for attempt := 1; ; attempt++ {
+			index, err := readIndexGeneration(ctx, object, cacheKey{location, attrs.Generation}, cache, parse)
+			if err != ErrGenerationMismatch {
+				return index, err
+			}
+			if attempt == maximumIndexAttempts {
+				return nil, newStorageError("reading index", err)
+			}
+			// The index was replaced after its attributes were read, so the new
+			// generation is read instead.
+			if attrs, err = object.Attrs(ctx); err != nil {
+				return nil, newStorageError("opening index", err)
+			}
+		}
+	}
+	return nil, newStorageError("opening index", err)
+}
+
+// readIndexGeneration uses parse to read the generation of the index object
+// identified by key, which is taken from the cache if possible.  It returns
+// ErrGenerationMismatch if the object no longer has that generation.
+func readIndexGeneration(ctx context.Context, object Object, key cacheKey, cache *lruCache, parse func(io.Reader) (interface{}, error)) (interface{}, error) {
+	if index, ok := cache.get(key); ok {
+		return index, nil
+	}
+	// Objects without a generation cannot be pinned or cached safely.
+	if key.generation != "" {
+		object = object.IfGenerationMatch(key.generation)
+	}
+
+	r, err := object.NewRangeReader(ctx, 0, -1)
+	if err == ErrGenerationMismatch {
+		return nil, err
+	} else if err != nil {
+		return nil, newStorageError("opening index", err)
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+	if err == ErrGenerationMismatch {
+		return nil, err
+	} else if err != nil {
+		return nil, newStorageError("reading index", err)
+	}
+	index, err := parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("reading index: %v", err)
+	}
+	if key.generation != "" {
+		cache.add(key, index, int64(len(data)))
+	}
+	return index, nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/cram"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+// This is generous since container headers only grow with the number of
+// slices in the container.
+const maximumContainerHeaderSize = 64 * 1024
+
+type cramRequest struct {
+	dataObject     Object
+	indexObjects   []Object
+	blockSizeLimit uint64
+	regions        []genomics.Region
+}
+
+// handle returns the chunks that cover the CRAM header and the containers
+// that hold data from the requested region, along with a data URL containing
+// the EOF container that should terminate the response.
+func (req *cramRequest) handle(ctx context.Context) ([]*bgzf.Chunk, string, error) {
+	data, err := req.dataObject.NewRangeReader(ctx, 0, int64(req.blockSizeLimit))
+	if err != nil {
+		return nil, "", newStorageError("opening data", err)
+	}
+	defer data.Close()
+
+	header, err := cram.ReadHeader(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading header: %v", err)
+	}
+	eof, err := header.EOF()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var crai io.ReadCloser
+	for _, object := range req.indexObjects {
+		crai, err = object.NewRangeReader(ctx, 0, -1)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, "", newStorageError("opening index", err)
+	}
+	defer crai.Close()
+
+	index, err := cram.ReadIndex(crai)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading index: %v", err)
+	}
+
+	// The index does not record container sizes, so the last container's
+	// header is read to find where the data ends and the EOF container begins.
+	end := header.Length
+	if last := index.LastContainer(); last > 0 {
+		container, err := req.dataObject.NewRangeReader(ctx, last, maximumContainerHeaderSize)
+		if err != nil {
+			return nil, "", newStorageError("opening last container", err)
+		}
+		defer container.Close()
+
+		size, err := cram.ReadContainerSize(container, header.MajorVersion)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading last container: %v", err)
+		}
+		end = last + size
+	}
+
+	chunks := []*bgzf.Chunk{{End: bgzf.NewAddress(uint64(header.Length), 0)}}
+	for _, region := range req.regions {
+		chunks = append(chunks, index.Chunks(region, end)...)
+	}
+	// CRAM containers are not indexed using BGZF addresses, so the chunks
+	// cannot be split.
+	return mergeBody(chunks, nil, req.blockSizeLimit), "data:;base64," + base64.StdEncoding.EncodeToString(eof), nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// NewGCSStorage returns a Storage that reads objects from Google Cloud Storage
+// using client.
+func NewGCSStorage(client *storage.Client) Storage {
+	return &gcsStorage{client: client}
+}
+
+// WithGCSSigningKey returns a copy of store that returns V4 signed URLs,
+// signed using the private key of the service account googleAccessID, when
+// clients are sent to read objects directly from GCS.  Otherwise, the URLs are
+// only readable by clients that are already authorized to read the objects
+// (or if the objects are public).  If store is not a GCS backend, it is
+// returned unchanged.
+func WithGCSSigningKey(store Storage, googleAccessID string, privateKey []byte) Storage {
+	gcs, ok := store.(*gcsStorage)
+	if !ok {
+		return store
+	}
+	return &gcsStorage{gcs.client, googleAccessID, privateKey}
+}
+
+type gcsStorage struct {
+	client *storage.Client
+
+	// If googleAccessID is not empty, direct URLs are signed using
+	// privateKey.
+	googleAccessID string
+	privateKey     []byte
+}
+
+func (gcs *gcsStorage) Object(bucket, name string) Object {
+	return &gcsObject{handle: gcs.client.Bucket(bucket).Object(name), store: gcs}
+}
+
+type gcsObject struct {
+	handle *storage.ObjectHandle
+	store  *gcsStorage
+	err    error
+}
+
+func (object *gcsObject) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+	r, err := object.handle.NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return r, nil
+}
+
+func (object *gcsObject) Attrs(ctx context.Context) (*ObjectAttrs, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+	attrs, err := object.handle.Attrs(ctx)
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	return &ObjectAttrs{
+		Size:       attrs.Size,
+		Generation: strconv.FormatInt(attrs.Generation, 10),
+	}, nil
+}
+
+func (object *gcsObject) IfGenerationMatch(generation string) Object {
+	// GCS generations are always numbers, so any other value cannot match.
+	n, err := strconv.ParseInt(generation, 10, 64)
+	if err != nil {
+		return &gcsObject{err: ErrGenerationMismatch}
+	}
+	return &gcsObject{handle: object.handle.If(storage.Conditions{GenerationMatch: n}), store: object.store}
+}
+
+func (object *gcsObject) DirectURL(generation string, expires time.Time) (string, bool, error) {
+	if object.err != nil {
+		return "", false, object.err
+	}
+
+	bucket, name := object.handle.BucketName(), object.handle.ObjectName()
+	query := make(url.Values)
+	if generation != "" {
+		query.Set("generation", generation)
+	}
+	if object.store.googleAccessID == "" {
+		u := url.URL{
+			Scheme:   "https",
+			Host:     "storage.googleapis.com",
+			Path:     "/" + bucket + "/" + name,
+			RawQuery: query.Encode(),
+		}
+		return u.String(), false, nil
+	}
+
+	signed, err := storage.SignedURL(bucket, name, &storage.SignedURLOptions{
+		GoogleAccessID:  object.store.googleAccessID,
+		PrivateKey:      object.store.privateKey,
+		Method:          http.MethodGet,
+		Expires:         expires,
+		Scheme:          storage.SigningSchemeV4,
+		QueryParameters: query,
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("signing URL: %v", err)
+	}
+	return signed, true, nil
+}
+
+func gcsError(err error) error {
+	if err == storage.ErrObjectNotExist {
+		return ErrObjectNotExist
+	}
+	if err, ok := err.(*googleapi.Error); ok && err.Code == http.StatusPreconditionFailed {
+		return ErrGenerationMismatch
+	}
+	return err
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// NewHTTPStorage returns a Storage that reads objects from web servers that
+// support range requests.  Each bucket name in roots is mapped to a base URL
+// and object names are interpreted as paths relative to that URL.  Index
+// files are expected to be found next to the data files.  If client is nil,
+// http.DefaultClient is used.
+func NewHTTPStorage(roots map[string]string, client *http.Client) (Storage, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	bases := make(map[string]*url.URL)
+	for name, root := range roots {
+		base, err := url.Parse(root)
+		if err != nil {
+			return nil, fmt.Errorf("parsing URL for %q: %v", name, err)
+		}
+		if base.Scheme != "http" && base.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported scheme for %q: %q", name, base.Scheme)
+		}
+		bases[name] = base
+	}
+	return &httpStorage{bases, client}, nil
+}
+
+type httpStorage struct {
+	bases  map[string]*url.URL
+	client *http.Client
+}
+
+func (store *httpStorage) Object(bucket, name string) Object {
+	base, ok := store.bases[bucket]
+	if !ok {
+		return &httpObject{err: ErrObjectNotExist}
+	}
+
+	// The name must not refer to a location outside of the base URL.
+	prefix := strings.TrimSuffix(base.Path, "/") + "/"
+	u := *base
+	u.Path = path.Join(prefix, name)
+	if !strings.HasPrefix(u.Path, prefix) || u.Path == prefix {
+		return &httpObject{err: errOutsideRoot}
+	}
+	return &httpObject{url: u.String(), send: store.client.Do}
+}
+
+// httpObject reads an object from a URL using range requests.  Each request
+// is sent using send.
+type httpObject struct {
+	url  string
+	send func(*http.Request) (*http.Response, error)
+	err  error
+
+	// If generation is not empty, the object must have this generation.
+	generation string
+}
+
+func (object *httpObject) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+	if length == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	byteRange := fmt.Sprintf("bytes=%d-", offset)
+	if length > 0 {
+		byteRange += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := object.do(ctx, "GET", byteRange)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent {
+		if err := object.checkGeneration(resp.Header); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, _, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if start != offset {
+			resp.Body.Close()
+			return nil, fmt.Errorf("server returned data from offset %d, want %d", start, offset)
+		}
+		return resp.Body, nil
+	case http.StatusOK:
+		// The server ignored the range, so skip to the requested data.
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil && err != io.EOF {
+			resp.Body.Close()
+			return nil, fmt.Errorf("skipping to offset %d: %v", offset, err)
+		}
+		if length < 0 {
+			return resp.Body, nil
+		}
+		return &readCloser{io.LimitReader(resp.Body, length), resp.Body}, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The range starts past the end of the object.
+		resp.Body.Close()
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	return nil, newStatusError(resp)
+}
+
+func (object *httpObject) Attrs(ctx context.Context) (*ObjectAttrs, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+
+	resp, err := object.do(ctx, "HEAD", "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	size := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		// Some servers do not support HEAD requests, so the size is read from
+		// the response to a request for the first byte instead.
+		resp, err = object.do(ctx, "GET", "bytes=0-0")
+		if err != nil {
+			return nil, err
+		}
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+			if _, size, err = parseContentRange(resp.Header.Get("Content-Range")); err != nil {
+				resp.Body.Close()
+				return nil, err
+			}
+		case http.StatusOK:
+			size = resp.ContentLength
+		default:
+			return nil, newStatusError(resp)
+		}
+		resp.Body.Close()
+	default:
+		return nil, newStatusError(resp)
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("missing object size")
+	}
+
+	if err := object.checkGeneration(resp.Header); err != nil {
+		return nil, err
+	}
+	return &ObjectAttrs{Size: size, Generation: responseGeneration(resp.Header)}, nil
+}
+
+func (object *httpObject) IfGenerationMatch(generation string) Object {
+	return &httpObject{object.url, object.send, object.err, generation}
+}
+
+// checkGeneration returns ErrGenerationMismatch if the object must have a
+// particular generation and the response headers report a different one.
+func (object *httpObject) checkGeneration(header http.Header) error {
+	if object.generation != "" && responseGeneration(header) != object.generation {
+		return ErrGenerationMismatch
+	}
+	return nil
+}
+
+// responseGeneration returns the generation of an object from the headers of
+// a response containing it.  Versioned S3 buckets identify each version of an
+// object, otherwise the entity tag (or failing that, the modification time) is
+// used to detect changes to the object.  Objects that were written before
+// versioning was enabled on a bucket have the version "null", which does not
+// change when the object is replaced.  Entity tags keep their quotes, so that
+// they can be told apart from version IDs.
+func responseGeneration(header http.Header) string {
+	if version := header.Get("X-Amz-Version-Id"); version != "" && version != "null" {
+		return version
+	}
+	if etag := header.Get("ETag"); etag != "" {
+		return etag
+	}
+	return header.Get("Last-Modified")
+}
+
+// setPrecondition adds a header to a request for an object that must have
+// generation, so that the server rejects the request if the object has
+// changed.  Weak entity tags cannot be used in preconditions and S3 version
+// IDs are only checked once the response has been received.
+func setPrecondition(header http.Header, generation string) {
+	if strings.HasPrefix(generation, `"`) {
+		header.Set("If-Match", generation)
+	} else if _, err := http.ParseTime(generation); err == nil {
+		header.Set("If-Unmodified-Since", generation)
+	}
+}
+
+// do sends a request for the object using method and the optional byteRange.
+// A missing object is reported as ErrObjectNotExist and a failed generation
+// precondition as ErrGenerationMismatch.
+func (object *httpObject) do(ctx context.Context, method, byteRange string) (*http.Response, error) {
+	req, err := http.NewRequest(method, object.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %v", err)
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	if object.generation != "" {
+		setPrecondition(req.Header, object.generation)
+	}
+
+	resp, err := object.send(req.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("sending request: %v", err)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrObjectNotExist
+	case http.StatusPreconditionFailed:
+		resp.Body.Close()
+		return nil, ErrGenerationMismatch
+	}
+	return resp, nil
+}
+
+// parseContentRange parses a Content-Range header of the form
+// "bytes start-end/size" and returns the start offset and the size of the
+// object (or -1 if the size is unknown).
+func parseContentRange(header string) (int64, int64, error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", header)
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, invalid
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, invalid
+	}
+	dash := strings.IndexByte(parts[0], '-')
+	if dash < 0 {
+		return 0, 0, invalid
+	}
+	start, err := strconv.ParseInt(parts[0][:dash], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	if parts[1] == "*" {
+		return start, -1, nil
+	}
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, invalid
+	}
+	return start, size, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errOutsideRoot = errors.New("path is outside of the root directory")
+
+// NewLocalStorage returns a Storage that reads objects from the local
+// filesystem.  Each bucket name in roots is mapped to a root directory and
+// object names are interpreted as slash separated paths relative to that
+// directory.  Objects outside of the root directories cannot be read, even
+// through symbolic links.
+func NewLocalStorage(roots map[string]string) Storage {
+	return &localStorage{roots}
+}
+
+type localStorage struct {
+	roots map[string]string
+}
+
+func (local *localStorage) Object(bucket, name string) Object {
+	root, ok := local.roots[bucket]
+	if !ok {
+		return &localObject{err: ErrObjectNotExist}
+	}
+	path, err := resolveLocalPath(root, name)
+	return &localObject{path: path, err: err}
+}
+
+// resolveLocalPath returns the path of the file called name under root, or
+// an error if the file lies outside of root.
+func resolveLocalPath(root, name string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", fmt.Errorf("resolving root: %v", err)
+	}
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if !isWithin(root, path) {
+		return "", errOutsideRoot
+	}
+
+	// Symbolic links are resolved so that a link inside the root cannot be used
+	// to read files outside of it.  Missing files are reported when they are
+	// opened.
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("resolving root: %v", err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return path, nil
+		}
+		return "", fmt.Errorf("resolving path: %v", err)
+	}
+	if !isWithin(resolvedRoot, resolved) {
+		return "", errOutsideRoot
+	}
+	return resolved, nil
+}
+
+// isWithin returns true if path is inside of the directory root.  Both paths
+// must be absolute and clean.
+func isWithin(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+type localObject struct {
+	path string
+	err  error
+
+	// If generation is not empty, the file must have this generation.
+	generation string
+}
+
+func (object *localObject) NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+
+	f, err := os.Open(object.path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading file information: %v", err)
+		}
+		return nil, ErrObjectNotExist
+	}
+	if object.generation != "" && localGeneration(info) != object.generation {
+		f.Close()
+		return nil, ErrGenerationMismatch
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("seeking to %d: %v", offset, err)
+	}
+
+	var r io.Reader = f
+	if length >= 0 {
+		r = io.LimitReader(f, length)
+	}
+	return &readCloser{r, f}, nil
+}
+
+func (object *localObject) Attrs(ctx context.Context) (*ObjectAttrs, error) {
+	if object.err != nil {
+		return nil, object.err
+	}
+
+	info, err := os.Stat(object.path)
+	if err != nil {
+		return nil, localError(err)
+	}
+	if info.IsDir() {
+		return nil, ErrObjectNotExist
+	}
+	generation := localGeneration(info)
+	if object.generation != "" && generation != object.generation {
+		return nil, ErrGenerationMismatch
+	}
+	return &ObjectAttrs{Size: info.Size(), Generation: generation}, nil
+}
+
+func (object *localObject) IfGenerationMatch(generation string) Object {
+	return &localObject{object.path, object.err, generation}
+}
+
+// localGeneration returns the generation of the file described by info.
+// There is no generation number, so the modification time and size are used
+// to detect changes to the file (the modification time alone may not change if
+// the file is rewritten quickly on a file system with coarse timestamps).
+func localGeneration(info os.FileInfo) string {
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
+
+func localError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrObjectNotExist
+	}
+	return err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,224 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+// The bin of a record without a position (reg2bin(-1, 0)).
+const unmappedBin = 4680
+
+var samFields = []string{"QNAME", "FLAG", "RNAME", "POS", "MAPQ", "CIGAR", "RNEXT", "PNEXT", "TLEN", "SEQ", "QUAL"}
+
+// projection selects the fields and tags of BAM records that are returned to
+// the client.  A nil map selects everything.
+type projection struct {
+	fields, tags, notags map[string]bool
+}
+
+// newProjection returns the projection described by the fields, tags and
+// notags request parameters.  It returns nil if every field and tag is
+// selected.
+func newProjection(fields, tags, notags []string) (*projection, error) {
+	if fields == nil && tags == nil && len(notags) == 0 {
+		return nil, nil
+	}
+
+	var p projection
+	if fields != nil {
+		p.fields = make(map[string]bool)
+		for _, field := range fields {
+			if !isSAMField(field) {
+				return nil, fmt.Errorf("unknown field %q", field)
+			}
+			p.fields[field] = true
+		}
+	}
+	if tags != nil {
+		p.tags = make(map[string]bool)
+		for _, tag := range tags {
+			if len(tag) != 2 {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			p.tags[tag] = true
+		}
+	}
+	if len(notags) > 0 {
+		p.notags = make(map[string]bool)
+		for _, tag := range notags {
+			if len(tag) != 2 {
+				return nil, fmt.Errorf("invalid tag %q", tag)
+			}
+			if p.tags[tag] {
+				return nil, fmt.Errorf("tag %q is both included and excluded", tag)
+			}
+			p.notags[tag] = true
+		}
+	}
+	return &p, nil
+}
+
+func isSAMField(name string) bool {
+	for _, field := range samFields {
+		if name == field {
+			return true
+		}
+	}
+	return false
+}
+
+// parseProjection returns the projection encoded in query by values, or nil
+// if query does not specify a projection.
+func parseProjection(query url.Values) (*projection, error) {
+	return newProjection(splitList(query, "fields"), splitList(query, "tags"), splitList(query, "notags"))
+}
+
+// values returns the query parameters that encode p.
+func (p *projection) values() url.Values {
+	join := func(set map[string]bool) string {
+		var names []string
+		for name := range set {
+			names = append(names, name)
+		}
+		// Sort the names so that the same projection always has the same URL.
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+
+	query := make(url.Values)
+	if p.fields != nil {
+		// Keep the fields in their canonical order so that URLs are stable.
+		var names []string
+		for _, field := range samFields {
+			if p.fields[field] {
+				names = append(names, field)
+			}
+		}
+		query.Set("fields", strings.Join(names, ","))
+	}
+	if p.tags != nil {
+		query.Set("tags", join(p.tags))
+	}
+	if p.notags != nil {
+		query.Set("notags", join(p.notags))
+	}
+	return query
+}
+
+func (p *projection) selected(field string) bool {
+	return p.fields == nil || p.fields[field]
+}
+
+// filter returns a reader that applies p to every record in the BGZF stream
+// read from r.  The records are returned in a new BGZF stream.  Closing the
+// returned reader also closes r.
+func (p *projection) filter(r io.ReadCloser) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		pw.CloseWithError(p.copy(pw, r))
+	}()
+	return pr
+}
+
+func (p *projection) copy(w io.Writer, r io.Reader) error {
+	records := bam.NewReader(r)
+	bw := bgzf.NewWriter(w, 0)
+	out := bam.NewWriter(bw)
+	for {
+		record, err := records.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("reading record: %v", err)
+		}
+		p.apply(record)
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	// The writer is not closed since tickets end with their own EOF marker.
+	return bw.Flush()
+}
+
+// apply sets the unselected fields of record to their default values and
+// removes the unselected tags.
+func (p *projection) apply(record *bam.Record) {
+	if !p.selected("QNAME") {
+		record.Name = "*"
+	}
+	if !p.selected("FLAG") {
+		record.Flag = 0
+	}
+	if !p.selected("RNAME") {
+		record.ReferenceID = -1
+	}
+	if !p.selected("POS") {
+		record.Position = -1
+		record.Bin = unmappedBin
+	}
+	if !p.selected("MAPQ") {
+		record.MappingQuality = 255
+	}
+	if !p.selected("CIGAR") {
+		record.Cigar = nil
+	}
+	if !p.selected("RNEXT") {
+		record.NextReferenceID = -1
+	}
+	if !p.selected("PNEXT") {
+		record.NextPosition = -1
+	}
+	if !p.selected("TLEN") {
+		record.TemplateLength = 0
+	}
+
+	// A missing sequence cannot have qualities, so the sequence is only
+	// removed if both are unselected.  Otherwise, the bases are replaced by N
+	// or the qualities by 0xff (missing).
+	switch seqSelected, qualSelected := p.selected("SEQ"), p.selected("QUAL"); {
+	case !seqSelected && !qualSelected:
+		record.Sequence, record.Qualities = nil, nil
+	case !seqSelected:
+		record.Sequence = repeated(0xff, len(record.Sequence))
+	case !qualSelected:
+		record.Qualities = repeated(0xff, len(record.Qualities))
+	}
+
+	tags := record.Tags[:0]
+	for _, tag := range record.Tags {
+		if name := tag.Name(); (p.tags == nil || p.tags[name]) && !p.notags[name] {
+			tags = append(tags, tag)
+		}
+	}
+	record.Tags = tags
+}
+
+func repeated(value byte, count int) []byte {
+	b := make([]byte, count)
+	for i := range b {
+		b[i] = value
+	}
+	return b
+}
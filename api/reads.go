@@ -15,38 +15,101 @@
 package api
 
 import (
+	"bytes"
 	"context"
-	"fmt"
+	"io"
+	"io/ioutil"
 
-	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/internal/bam"
 	"github.com/googlegenomics/htsget/internal/bgzf"
 	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
 type readsRequest struct {
-	indexObjects   []*storage.ObjectHandle
+	dataObject     Object
+	store          Storage
+	indexes        []Location
+	indexCache     *lruCache
 	blockSizeLimit uint64
-	region         genomics.Region
+	regions        []genomics.Region
+
+	// boundaries is set by handle to the addresses of the records recorded in
+	// the index.
+	boundaries []bgzf.Address
 }
 
 func (req *readsRequest) handle(ctx context.Context) ([]*bgzf.Chunk, error) {
-	var index *storage.Reader
-	var err error
-	for _, object := range req.indexObjects {
-		index, err = object.NewReader(ctx)
-		if err == nil {
-			break
+	parsed, err := readIndex(ctx, req.store, req.indexCache, req.indexes, func(r io.Reader) (interface{}, error) {
+		return bam.ReadIndex(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := parsed.(*bam.Index)
+
+	var chunks []*bgzf.Chunk
+	for i, region := range req.regions {
+		regionChunks := index.Query(region)
+		// Every set of chunks starts with the header, which is only needed once.
+		if i > 0 {
+			regionChunks = regionChunks[1:]
 		}
+		chunks = append(chunks, regionChunks...)
 	}
-	if err != nil {
-		return nil, newStorageError("opening index", err)
+
+	// Indexes do not record where the data ends, so chunks that extend to the
+	// end of the data (such as those covering unplaced unmapped reads) are
+	// given a real end address.
+	var end bgzf.Address
+	for _, chunk := range chunks {
+		if chunk.End != bgzf.LastAddress {
+			continue
+		}
+		if end == 0 {
+			if end, err = dataEnd(ctx, req.dataObject); err != nil {
+				return nil, err
+			}
+		}
+		chunk.End = end
+	}
+
+	// The unplaced unmapped reads are assumed to follow the mapped reads when
+	// the index does not count them, so their chunk is empty if the mapped
+	// reads run to the end of the data.
+	var nonEmpty []*bgzf.Chunk
+	for _, chunk := range chunks {
+		if chunk.End > chunk.Start {
+			nonEmpty = append(nonEmpty, chunk)
+		}
 	}
-	defer index.Close()
+	req.boundaries = index.Boundaries()
+	return mergeBody(nonEmpty, req.boundaries, req.blockSizeLimit), nil
+}
 
-	chunks, err := bam.Read(index, req.region)
+// dataEnd returns the address at which the data in the BGZF file object ends,
+// which excludes the EOF marker (if any) since a separate EOF marker is always
+// added to tickets.
+func dataEnd(ctx context.Context, object Object) (bgzf.Address, error) {
+	attrs, err := object.Attrs(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("reading index: %v", err)
+		return 0, newStorageError("reading data attributes", err)
+	}
+
+	size, markerSize := attrs.Size, int64(len(bgzf.EOFMarker))
+	if size >= markerSize {
+		r, err := object.NewRangeReader(ctx, size-markerSize, markerSize)
+		if err != nil {
+			return 0, newStorageError("opening data", err)
+		}
+		defer r.Close()
+
+		tail, err := ioutil.ReadAll(r)
+		if err != nil {
+			return 0, newStorageError("reading data", err)
+		}
+		if bytes.Equal(tail, bgzf.EOFMarker) {
+			size -= markerSize
+		}
 	}
-	return bgzf.Merge(chunks, req.blockSizeLimit), nil
+	return bgzf.NewAddress(uint64(size), 0), nil
 }
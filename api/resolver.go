@@ -0,0 +1,210 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// ErrUnknownID is returned by an IDResolver when an ID does not identify any
+// dataset.
+var ErrUnknownID = errors.New("unknown ID")
+
+// IDResolver maps the IDs used in requests to the locations of the data they
+// identify.
+type IDResolver interface {
+	// Resolve returns the dataset identified by id.  It returns ErrUnknownID if
+	// there is no such dataset.
+	Resolve(id string) (*Dataset, error)
+}
+
+// Location identifies an object held by a storage backend.
+type Location struct {
+	Bucket, Object string
+}
+
+// Dataset describes where the data for an ID is stored.
+type Dataset struct {
+	// Data is the location of the BAM, CRAM, VCF or BCF file.
+	Data Location
+
+	// Indexes lists the locations where an index of the data may be found in
+	// order of preference.  If it is empty, the index is expected to be next to
+	// the data and named using the usual conventions for the format.
+	Indexes []Location
+}
+
+// pathResolver interprets IDs as "bucket/object" paths.  It is used unless the
+// server is configured with a different resolver.
+type pathResolver struct{}
+
+func (pathResolver) Resolve(id string) (*Dataset, error) {
+	location, err := parseLocation(id)
+	if err != nil {
+		return nil, err
+	}
+	return &Dataset{Data: location}, nil
+}
+
+// ResolverConfig is the configuration of an IDResolver that maps stable IDs to
+// locations in storage.  Locations are written as "bucket/object" paths.
+type ResolverConfig struct {
+	// Datasets maps IDs directly to the locations of their data.
+	Datasets map[string]DatasetConfig `json:"datasets"`
+
+	// Rules rewrite IDs that are not listed in Datasets.  The first rule whose
+	// pattern matches the whole ID is used.
+	Rules []RuleConfig `json:"rules"`
+}
+
+// DatasetConfig lists the locations of a dataset and its indexes.
+type DatasetConfig struct {
+	Data    string   `json:"data"`
+	Indexes []string `json:"indexes"`
+}
+
+// RuleConfig rewrites the IDs that match Pattern, which is a regular
+// expression, into locations.  The templates in Data and Indexes may refer to
+// submatches of the pattern using the syntax of regexp.Regexp.Expand, such as
+// "$1" or "${sample}".
+type RuleConfig struct {
+	Pattern string `json:"pattern"`
+	DatasetConfig
+}
+
+type configResolver struct {
+	datasets map[string]*Dataset
+	rules    []*rule
+}
+
+type rule struct {
+	pattern *regexp.Regexp
+	data    string
+	indexes []string
+}
+
+// NewConfigResolver returns an IDResolver that resolves IDs as described by
+// config.  IDs that are neither listed nor matched by a rule are unknown.
+func NewConfigResolver(config *ResolverConfig) (IDResolver, error) {
+	resolver := &configResolver{datasets: make(map[string]*Dataset)}
+	for id, dataset := range config.Datasets {
+		resolved, err := newDataset(dataset.Data, dataset.Indexes)
+		if err != nil {
+			return nil, fmt.Errorf("dataset %q: %v", id, err)
+		}
+		resolver.datasets[id] = resolved
+	}
+	for i, config := range config.Rules {
+		if config.Data == "" {
+			return nil, fmt.Errorf("rule %d: no data location specified", i)
+		}
+		// Patterns are anchored so that a rule never matches part of an ID.
+		pattern, err := regexp.Compile("^(?:" + config.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: parsing pattern: %v", i, err)
+		}
+		resolver.rules = append(resolver.rules, &rule{pattern, config.Data, config.Indexes})
+	}
+	return resolver, nil
+}
+
+// LoadConfigResolver reads a JSON encoded ResolverConfig from r and returns
+// the IDResolver that it describes.
+func LoadConfigResolver(r io.Reader) (IDResolver, error) {
+	var config ResolverConfig
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return nil, fmt.Errorf("decoding config: %v", err)
+	}
+	return NewConfigResolver(&config)
+}
+
+func (resolver *configResolver) Resolve(id string) (*Dataset, error) {
+	if dataset, ok := resolver.datasets[id]; ok {
+		return dataset, nil
+	}
+
+	for _, rule := range resolver.rules {
+		match := rule.pattern.FindStringSubmatchIndex(id)
+		if match == nil {
+			continue
+		}
+		expand := func(template string) string {
+			return string(rule.pattern.ExpandString(nil, template, id, match))
+		}
+		indexes := make([]string, len(rule.indexes))
+		for i, index := range rule.indexes {
+			indexes[i] = expand(index)
+		}
+		dataset, err := newDataset(expand(rule.data), indexes)
+		if err != nil {
+			return nil, fmt.Errorf("rewriting %q: %v", id, err)
+		}
+		return dataset, nil
+	}
+	return nil, ErrUnknownID
+}
+
+// newDataset returns a dataset with the given data and index locations.
+func newDataset(data string, indexes []string) (*Dataset, error) {
+	location, err := parseLocation(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing data location %q: %v", data, err)
+	}
+	dataset := &Dataset{Data: location}
+	for _, index := range indexes {
+		location, err := parseLocation(index)
+		if err != nil {
+			return nil, fmt.Errorf("parsing index location %q: %v", index, err)
+		}
+		dataset.Indexes = append(dataset.Indexes, location)
+	}
+	return dataset, nil
+}
+
+// parseLocation parses a "bucket/object" path.
+func parseLocation(path string) (Location, error) {
+	if parts := strings.SplitN(path, "/", 2); len(parts) == 2 {
+		if parts[0] != "" && parts[1] != "" {
+			return Location{parts[0], parts[1]}, nil
+		}
+	}
+	return Location{}, errInvalidOrUnspecifiedID
+}
+
+// indexLocations returns the locations of the index of dataset.  If the
+// dataset does not list any, the index is expected to be found next to the
+// data with one of suffixes (in order of preference) either appended to the
+// name of the data or replacing its extension.
+func (dataset *Dataset) indexLocations(extension string, suffixes ...string) []Location {
+	if len(dataset.Indexes) > 0 {
+		return dataset.Indexes
+	}
+	data := dataset.Data
+	var locations []Location
+	for _, suffix := range suffixes {
+		locations = append(locations, Location{data.Bucket, data.Object + suffix})
+		if strings.HasSuffix(data.Object, extension) {
+			locations = append(locations, Location{data.Bucket, strings.TrimSuffix(data.Object, extension) + suffix})
+		}
+	}
+	return locations
+}
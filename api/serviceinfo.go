@@ -0,0 +1,164 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+)
+
+const (
+	// Each endpoint describes itself at serviceInfoPath below its own path.
+	// The top-level path describes the reads endpoint.
+	serviceInfoPath = "service-info"
+
+	// The version of the htsget protocol implemented by the server.
+	htsgetVersion = "1.2.0"
+)
+
+// ServiceInfo describes a deployment of the server.  It is returned to clients
+// by the GA4GH service-info endpoint.
+type ServiceInfo struct {
+	// ID uniquely identifies the service, using reverse domain name notation
+	// (for example, "org.example.htsget").
+	ID string
+
+	// Name and Description are human readable descriptions of the service.
+	Name, Description string
+
+	// OrganizationName and OrganizationURL identify the organization that
+	// provides the service.
+	OrganizationName, OrganizationURL string
+
+	// ContactURL and DocumentationURL are optional URLs (which may be mailto
+	// URLs) that describe how to get help with the service.
+	ContactURL, DocumentationURL string
+
+	// Environment describes the deployment, such as "test" or "prod".
+	Environment string
+
+	// Version is the version of the deployed service.
+	Version string
+}
+
+// defaultServiceInfo leaves the ID and organization empty, since they
+// identify the deployment rather than the server.
+var defaultServiceInfo = ServiceInfo{
+	Name:        "htsget",
+	Description: "An htsget server that provides access to indexed genomic data files.",
+	Version:     htsgetVersion,
+}
+
+// SetServiceInfo configures the details that are reported by the service-info
+// endpoint.  Any empty fields in info keep their default values.
+func (server *Server) SetServiceInfo(info ServiceInfo) {
+	set := func(value string, field *string) {
+		if value != "" {
+			*field = value
+		}
+	}
+	set(info.ID, &server.serviceInfo.ID)
+	set(info.Name, &server.serviceInfo.Name)
+	set(info.Description, &server.serviceInfo.Description)
+	set(info.OrganizationName, &server.serviceInfo.OrganizationName)
+	set(info.OrganizationURL, &server.serviceInfo.OrganizationURL)
+	set(info.ContactURL, &server.serviceInfo.ContactURL)
+	set(info.DocumentationURL, &server.serviceInfo.DocumentationURL)
+	set(info.Environment, &server.serviceInfo.Environment)
+	set(info.Version, &server.serviceInfo.Version)
+}
+
+type serviceType struct {
+	Group    string `json:"group"`
+	Artifact string `json:"artifact"`
+	Version  string `json:"version"`
+}
+
+type organization struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// htsgetInfo describes the capabilities of a single htsget endpoint.
+type htsgetInfo struct {
+	Datatype string   `json:"datatype"`
+	Formats  []string `json:"formats"`
+
+	// These are true if the parameters are honoured for at least one of the
+	// formats.
+	FieldsParametersEffective bool `json:"fieldsParametersEffective"`
+	TagsParametersEffective   bool `json:"tagsParametersEffective"`
+}
+
+var (
+	readsInfo = htsgetInfo{
+		Datatype: "reads",
+		Formats:  []string{"BAM", "CRAM"},
+		// Fields and tags are only honoured for BAM.
+		FieldsParametersEffective: true,
+		TagsParametersEffective:   true,
+	}
+	variantsInfo = htsgetInfo{
+		Datatype: "variants",
+		Formats:  []string{"VCF", "BCF"},
+	}
+	// Any bgzipped text file with a tabix index, such as BED, GFF or GTF, is
+	// returned in the TABIX format.
+	tabixInfo = htsgetInfo{
+		Datatype: "tabix",
+		Formats:  []string{"TABIX"},
+	}
+)
+
+// serviceInfoResponse follows the GA4GH service-info schema, extended with
+// the htsget specific capabilities of the server.
+type serviceInfoResponse struct {
+	ID               string       `json:"id"`
+	Name             string       `json:"name"`
+	Type             serviceType  `json:"type"`
+	Description      string       `json:"description,omitempty"`
+	Organization     organization `json:"organization"`
+	ContactURL       string       `json:"contactUrl,omitempty"`
+	DocumentationURL string       `json:"documentationUrl,omitempty"`
+	Environment      string       `json:"environment,omitempty"`
+	Version          string       `json:"version"`
+	HTSGet           htsgetInfo   `json:"htsget"`
+}
+
+// serveServiceInfo returns a handler that describes the endpoint with the
+// capabilities in endpoint.
+func (server *Server) serveServiceInfo(endpoint htsgetInfo) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		info := server.serviceInfo
+		writeJSON(w, http.StatusOK, &serviceInfoResponse{
+			ID:   info.ID,
+			Name: info.Name,
+			Type: serviceType{
+				Group:    "org.ga4gh",
+				Artifact: "htsget",
+				Version:  htsgetVersion,
+			},
+			Description: info.Description,
+			Organization: organization{
+				Name: info.OrganizationName,
+				URL:  info.OrganizationURL,
+			},
+			ContactURL:       info.ContactURL,
+			DocumentationURL: info.DocumentationURL,
+			Environment:      info.Environment,
+			Version:          info.Version,
+			HTSGet:           endpoint,
+		})
+	}
+}
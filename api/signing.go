@@ -0,0 +1,108 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// The length of the randomly generated key used when no signing key is
+	// configured.
+	defaultSigningKeySize = 32
+
+	// The length of time for which block URLs in a ticket remain valid.
+	defaultTicketLifetime = time.Hour
+
+	// The query parameters that hold the expiry time and signature of a block
+	// URL.  The signature is always the last parameter and covers everything
+	// that precedes it.
+	expiresParameter   = "expires"
+	signatureParameter = "signature"
+)
+
+var (
+	errMissingSignature = errors.New("block URL is not signed")
+	errInvalidSignature = errors.New("block URL signature does not match")
+	errExpiredSignature = errors.New("block URL has expired")
+)
+
+// urlSigner signs and verifies block URLs using HMAC-SHA256 so that clients
+// can only fetch the parts of objects that the server included in a ticket.
+type urlSigner struct {
+	key []byte
+}
+
+// newRandomSigner returns a urlSigner with a randomly generated key.  URLs
+// signed with it cannot be verified by other servers or after a restart.
+func newRandomSigner() *urlSigner {
+	key := make([]byte, defaultSigningKeySize)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Generating signing key: %v", err)
+	}
+	return &urlSigner{key}
+}
+
+// sign returns rawQuery with an expiry time and a signature covering path
+// (which identifies the object), rawQuery (which identifies the chunk and how
+// its records are returned) and the expiry time appended.
+func (signer *urlSigner) sign(path, rawQuery string, expires time.Time) string {
+	rawQuery += fmt.Sprintf("&%s=%d", expiresParameter, expires.Unix())
+	return rawQuery + "&" + signatureParameter + "=" + signer.mac(path, rawQuery)
+}
+
+// verify checks that rawQuery was returned by sign for path and that it has
+// not expired at now.  It returns rawQuery without the expiry time and
+// signature.
+func (signer *urlSigner) verify(path, rawQuery string, now time.Time) (string, error) {
+	i := strings.LastIndex(rawQuery, "&"+signatureParameter+"=")
+	if i < 0 {
+		return "", newPermissionDeniedError("checking signature", errMissingSignature)
+	}
+	signed, signature := rawQuery[:i], rawQuery[i+len(signatureParameter)+2:]
+	if !hmac.Equal([]byte(signature), []byte(signer.mac(path, signed))) {
+		return "", newInvalidAuthenticationError("checking signature", errInvalidSignature)
+	}
+
+	j := strings.LastIndex(signed, "&"+expiresParameter+"=")
+	if j < 0 {
+		return "", newInvalidAuthenticationError("checking signature", errInvalidSignature)
+	}
+	expires, err := strconv.ParseInt(signed[j+len(expiresParameter)+2:], 10, 64)
+	if err != nil {
+		return "", newInvalidAuthenticationError("parsing expiry time", err)
+	}
+	if now.Unix() > expires {
+		return "", newInvalidAuthenticationError("checking signature", errExpiredSignature)
+	}
+	return signed[:j], nil
+}
+
+func (signer *urlSigner) mac(path, rawQuery string) string {
+	h := hmac.New(sha256.New, signer.key)
+	h.Write([]byte(path))
+	h.Write([]byte{'?'})
+	h.Write([]byte(rawQuery))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
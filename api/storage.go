@@ -0,0 +1,126 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The amount of an error response that is included in the error message.
+const maximumErrorMessageSize = 1024
+
+// ErrObjectNotExist is returned by storage backends when the requested object
+// does not exist.
+var ErrObjectNotExist = errors.New("object does not exist")
+
+// ErrGenerationMismatch is returned by storage backends when an object is read
+// using a handle returned by IfGenerationMatch and the object has since been
+// changed.
+var ErrGenerationMismatch = errors.New("object generation does not match")
+
+// Storage provides access to the objects held by a storage backend.
+type Storage interface {
+	// Object returns a handle to the object called name in bucket.  The object
+	// is not accessed until one of the methods of the handle is called.
+	Object(bucket, name string) Object
+}
+
+// Object is a handle to a single object in a Storage backend.
+type Object interface {
+	// NewRangeReader returns a reader for length bytes of the object starting
+	// at offset.  If length is negative, the object is read until its end.  A
+	// range that extends past the end of the object is truncated.
+	NewRangeReader(ctx context.Context, offset, length int64) (io.ReadCloser, error)
+
+	// Attrs returns the attributes of the object.
+	Attrs(ctx context.Context) (*ObjectAttrs, error)
+
+	// IfGenerationMatch returns a handle to the same object whose reads fail
+	// with ErrGenerationMismatch unless the object's generation (as reported
+	// by Attrs) is generation.
+	IfGenerationMatch(generation string) Object
+}
+
+// DirectObject is implemented by the Objects of storage backends that clients
+// can read from directly, without the data passing through the server.
+type DirectObject interface {
+	Object
+
+	// DirectURL returns a URL from which clients can read the object until
+	// expires.  If generation is not empty, the URL must only return that
+	// generation of the object.  If signed is true, the URL carries its own
+	// authorization and no other credentials should be sent with it.
+	DirectURL(generation string, expires time.Time) (url string, signed bool, err error)
+}
+
+// ObjectAttrs holds the attributes of an object.
+type ObjectAttrs struct {
+	// Size is the length of the object in bytes.
+	Size int64
+
+	// Generation identifies the contents of the object.  It changes whenever
+	// the object is overwritten.
+	Generation string
+}
+
+// statusError is returned by HTTP based storage backends when a request fails
+// with an unexpected status code.
+type statusError struct {
+	code    int
+	message string
+}
+
+// newStatusError returns a statusError that describes resp and closes its
+// body.
+func newStatusError(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maximumErrorMessageSize))
+	return &statusError{resp.StatusCode, strings.TrimSpace(string(body))}
+}
+
+func (err *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d (%s): %s", err.code, http.StatusText(err.code), err.message)
+}
+
+// ParseRoots parses a comma separated list of name=location pairs into a map.
+// It is used to configure the backends that map bucket names to directories
+// or URLs.
+func ParseRoots(list string) (map[string]string, error) {
+	roots := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid root %q (want name=location)", pair)
+		}
+		if _, ok := roots[parts[0]]; ok {
+			return nil, fmt.Errorf("duplicate root name %q", parts[0])
+		}
+		roots[parts[0]] = parts[1]
+	}
+	return roots, nil
+}
+
+// NewStorageFunc is the type of function that constructs the appropriate
+// Storage to satisfy the incoming request.  Any headers that caused this
+// particular backend to be created are returned to allow block requests to be
+// generated correctly.
+type NewStorageFunc func(*http.Request) (Storage, http.Header, error)
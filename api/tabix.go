@@ -0,0 +1,62 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"io"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/tbi"
+)
+
+// tabixRequest finds the data in any bgzipped text file (such as BED, GFF or
+// GTF) that has a tabix index.  The header lines of the file are not indexed,
+// so they are always covered by the first chunk.
+type tabixRequest struct {
+	store          Storage
+	indexes        []Location
+	indexCache     *lruCache
+	blockSizeLimit uint64
+	regions        []queryRegion
+}
+
+func (req *tabixRequest) handle(ctx context.Context) ([]*bgzf.Chunk, error) {
+	parsed, err := readIndex(ctx, req.store, req.indexCache, req.indexes, func(r io.Reader) (interface{}, error) {
+		return tbi.ReadIndex(r)
+	})
+	if err != nil {
+		return nil, err
+	}
+	index := parsed.(*tbi.Index)
+
+	// Tabix indexes list the names of the references themselves, whatever the
+	// format of the data.
+	regions, err := resolveRegions(req.regions, index.ReferenceID)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []*bgzf.Chunk
+	for i, region := range regions {
+		regionChunks := index.Query(region)
+		// Every set of chunks starts with the header, which is only needed once.
+		if i > 0 {
+			regionChunks = regionChunks[1:]
+		}
+		chunks = append(chunks, regionChunks...)
+	}
+	return mergeBody(chunks, index.Boundaries(), req.blockSizeLimit), nil
+}
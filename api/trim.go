@@ -0,0 +1,228 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/googlegenomics/htsget/internal/bam"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+// trimRegions returns the regions that the records in BAM chunks can be
+// trimmed to, or nil if the records cannot be trimmed because some region
+// matches reads regardless of their position.
+func trimRegions(regions []genomics.Region) []genomics.Region {
+	for _, region := range regions {
+		if region.ReferenceID < 0 {
+			return nil
+		}
+	}
+	return regions
+}
+
+// trim returns the records in the chunk with those in its first and last
+// blocks that do not overlap any of the regions removed.  The blocks in
+// between are returned unchanged.  A record that continues past the end of the
+// chunk (which only happens when the chunk ends where the client reads the
+// next blocks directly from storage) is always kept.
+func (req *blockRequest) trim(ctx context.Context) (io.ReadCloser, error) {
+	start, end := req.chunk.Start, req.chunk.End
+	head, tail := int64(start.BlockOffset()), int64(end.BlockOffset())
+
+	length := tail - head
+	if end.DataOffset() != 0 {
+		length += bgzf.MaximumBlockSize
+	}
+	r, err := req.object.NewRangeReader(ctx, head, length)
+	if err != nil {
+		return nil, newStorageError("opening chunk", err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer r.Close()
+		pw.CloseWithError(req.copyTrimmed(pw, r))
+	}()
+	return pr, nil
+}
+
+// droppedRecord is a record that does not overlap any of the regions.  It
+// starts at offset in the decoded data of a block and has the given size,
+// including the leading block size.
+type droppedRecord struct {
+	offset, size int
+}
+
+// copyTrimmed writes the overlapping records of the chunk, which starts in the
+// first block read from r, to w.  Only the first and last blocks of the chunk
+// are encoded again: the blocks in between are decoded to follow the records
+// into the last block, but are written as they were read.
+func (req *blockRequest) copyTrimmed(w io.Writer, r io.Reader) error {
+	start, end := req.chunk.Start, req.chunk.End
+
+	// The addresses of the data read from r are relative to the first block.
+	// The compressed blocks are kept until they have been written.
+	var compressed bytes.Buffer
+	data := bgzf.NewReader(io.TeeReader(r, &compressed))
+	if _, err := io.CopyN(ioutil.Discard, data, int64(start.DataOffset())); err != nil {
+		return fmt.Errorf("reading to the start of the chunk: %v", err)
+	}
+	limit := bgzf.NewAddress(end.BlockOffset()-start.BlockOffset(), end.DataOffset())
+
+	// edge reports whether the block at offset, whose compressed size is size,
+	// is the first or last block of the chunk.  If the chunk ends at the start
+	// of a block, the last block is the one before it.
+	edge := func(offset uint64, size int) bool {
+		if offset == 0 {
+			return true
+		}
+		if limit.DataOffset() == 0 {
+			return offset+uint64(size) == limit.BlockOffset()
+		}
+		return offset == limit.BlockOffset()
+	}
+
+	// offset is the address of the next block to be written and dropped holds
+	// the records that start in it and can be removed if it is an edge block.
+	var offset uint64
+	var dropped []droppedRecord
+	flush := func(until uint64) error {
+		for offset < until {
+			block, err := bgzf.ReadBlock(&compressed)
+			if err == io.EOF {
+				// The chunk ends with the blocks that were read.
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("reading block: %v", err)
+			}
+			size := len(block)
+			if edge(offset, size) {
+				from, to := 0, -1
+				if offset == 0 {
+					from = int(start.DataOffset())
+				}
+				if offset == limit.BlockOffset() {
+					to = int(limit.DataOffset())
+				}
+				if block, err = trimBlock(block, from, to, dropped); err != nil {
+					return err
+				}
+			}
+			if len(block) > 0 {
+				if _, err := w.Write(block); err != nil {
+					return fmt.Errorf("writing block: %v", err)
+				}
+			}
+			offset += uint64(size)
+			dropped = nil
+		}
+		return nil
+	}
+
+	records := bam.NewReader(data)
+	for records.Address() < limit {
+		address := records.Address()
+		if err := flush(address.BlockOffset()); err != nil {
+			return err
+		}
+		record, err := records.ReadRaw()
+		if err == io.EOF || err == bam.ErrTruncatedRecord {
+			// The rest of a truncated record is in the blocks that follow the
+			// chunk, so it is kept.
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading record: %v", err)
+		}
+		// The block holding the start of the record is the next to be written.
+		size, err := bgzf.ReadBlockSize(bytes.NewReader(compressed.Bytes()))
+		if err != nil {
+			return fmt.Errorf("reading block size: %v", err)
+		}
+		if !edge(address.BlockOffset(), size) {
+			continue
+		}
+
+		overlaps, err := overlaps(record, req.regions)
+		if err != nil {
+			return err
+		}
+		if !overlaps {
+			dropped = append(dropped, droppedRecord{int(address.DataOffset()), 4 + len(record)})
+		}
+	}
+
+	until := limit.BlockOffset()
+	if limit.DataOffset() != 0 {
+		until++
+	}
+	return flush(until)
+}
+
+// trimBlock returns block encoded again with only its decoded data between
+// from and to (or the end of the block if to is negative), and without the
+// dropped records that end inside the block.  It returns no data if there are
+// no records left.
+func trimBlock(block []byte, from, to int, dropped []droppedRecord) ([]byte, error) {
+	data, _, err := bgzf.DecodeBlock(bytes.NewReader(block))
+	if err != nil {
+		return nil, fmt.Errorf("decoding block: %v", err)
+	}
+	if to < 0 {
+		to = len(data)
+	}
+	if from > to || to > len(data) {
+		return nil, fmt.Errorf("chunk does not fit in the block (%d-%d of %d bytes)", from, to, len(data))
+	}
+
+	trimmed := make([]byte, 0, to-from)
+	for _, record := range dropped {
+		if record.offset+record.size > to {
+			break
+		}
+		trimmed = append(trimmed, data[from:record.offset]...)
+		from = record.offset + record.size
+	}
+	trimmed = append(trimmed, data[from:to]...)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	return bgzf.EncodeBlock(trimmed)
+}
+
+// overlaps reports whether the encoded record (without the leading block size)
+// overlaps any of the regions.
+func overlaps(data []byte, regions []genomics.Region) (bool, error) {
+	record, err := bam.DecodeRecord(data)
+	if err != nil {
+		return false, fmt.Errorf("decoding record: %v", err)
+	}
+	for _, region := range regions {
+		if record.ReferenceID != region.ReferenceID {
+			continue
+		}
+		if (region.End == 0 || int64(record.Position) < int64(region.End)) && int64(record.End()) > int64(region.Start) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
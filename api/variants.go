@@ -0,0 +1,112 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/googlegenomics/htsget/internal/bcf"
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/csi"
+	"github.com/googlegenomics/htsget/internal/genomics"
+	"github.com/googlegenomics/htsget/internal/tbi"
+	"github.com/googlegenomics/htsget/internal/vcf"
+)
+
+// The magic at the start of an uncompressed tabix index.
+const tabixMagic = "TBI\x01"
+
+type variantsRequest struct {
+	format         string
+	dataObject     Object
+	store          Storage
+	indexes        []Location
+	indexCache     *lruCache
+	blockSizeLimit uint64
+	regions        []queryRegion
+}
+
+func (req *variantsRequest) handle(ctx context.Context) ([]*bgzf.Chunk, error) {
+	parsed, err := readIndex(ctx, req.store, req.indexCache, req.indexes, parseVariantsIndex)
+	if err != nil {
+		return nil, err
+	}
+
+	// CSI indexes identify references using the order of the contigs in the
+	// header of the data, while tabix indexes list the names themselves.
+	resolve := referenceResolver(ctx, req.dataObject, req.blockSizeLimit, getVCFReferenceID)
+	if req.format == "BCF" {
+		resolve = referenceResolver(ctx, req.dataObject, req.blockSizeLimit, getBCFReferenceID)
+	}
+	var query func(genomics.Region) []*bgzf.Chunk
+	var boundaries []bgzf.Address
+	switch index := parsed.(type) {
+	case *tbi.Index:
+		resolve, query, boundaries = index.ReferenceID, index.Query, index.Boundaries()
+	case *csi.Index:
+		query, boundaries = index.Query, index.Boundaries()
+	}
+	regions, err := resolveRegions(req.regions, resolve)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []*bgzf.Chunk
+	for i, region := range regions {
+		regionChunks := query(region)
+		// Every set of chunks starts with the header, which is only needed once.
+		if i > 0 {
+			regionChunks = regionChunks[1:]
+		}
+		chunks = append(chunks, regionChunks...)
+	}
+	return mergeBody(chunks, boundaries, req.blockSizeLimit), nil
+}
+
+// parseVariantsIndex parses either a tabix or a CSI index, which are told
+// apart using the magic at the start of their uncompressed data.
+func parseVariantsIndex(r io.Reader) (interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("initializing gzip reader: %v", err)
+	}
+	magic := make([]byte, len(tabixMagic))
+	if _, err := io.ReadFull(gzr, magic); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+	if string(magic) == tabixMagic {
+		return tbi.ReadIndex(bytes.NewReader(data))
+	}
+	return csi.ReadIndex(bytes.NewReader(data))
+}
+
+func getVCFReferenceID(r io.Reader, name string) (int32, error) {
+	id, err := vcf.GetReferenceID(r, name)
+	return int32(id), err
+}
+
+func getBCFReferenceID(r io.Reader, name string) (int32, error) {
+	id, err := bcf.GetReferenceID(r, name)
+	return int32(id), err
+}
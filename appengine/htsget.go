@@ -1,11 +1,11 @@
 package htsget
 
 import (
+	"log"
 	"net/http"
 	"os"
 	"strings"
 
-	"cloud.google.com/go/storage"
 	"github.com/googlegenomics/htsget/api"
 	"google.golang.org/appengine"
 )
@@ -16,10 +16,17 @@ func init() {
 	if list := os.Getenv("BUCKET_WHITELIST"); list != "" {
 		server.Whitelist(strings.Split(list, ","))
 	}
+	// Every instance must use the same key to accept block URLs from tickets
+	// issued by the others.
+	key := os.Getenv("SIGNING_KEY")
+	if key == "" {
+		log.Fatalf("The SIGNING_KEY environment variable must be set in app.yaml.")
+	}
+	server.SetSigningKey([]byte(key))
 	server.Export(mux)
 	http.HandleFunc("/", mux.ServeHTTP)
 }
 
-func newAppEngineClient(req *http.Request) (*storage.Client, http.Header, error) {
+func newAppEngineClient(req *http.Request) (api.Storage, http.Header, error) {
 	return api.NewClientFromBearerToken(req.WithContext(appengine.NewContext(req)))
 }
@@ -16,11 +16,15 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/googlegenomics/htsget/api"
@@ -30,13 +34,38 @@ import (
 var (
 	port      = flag.Int("port", 80, "HTTP service port")
 	blockSize = flag.Uint64("block_size", 1024*1024*1024, "block size soft limit")
+	cacheSize = flag.Int64("index_cache_size", 64*1024*1024, "approximate number of bytes of memory used to cache parsed indexes")
 
 	secure    = flag.Bool("secure", false, "serve in HTTPS-only mode and forward client bearer tokens")
 	httpsCert = flag.String("https_cert", "", "HTTPS certificate file")
 	httpsKey  = flag.String("https_key", "", "HTTPS key file")
 
+	signingKeyFile   = flag.String("signing_key_file", "", "file containing the key used to sign block URLs, which must be shared by all servers that share traffic")
+	randomSigningKey = flag.Bool("random_signing_key", false, "sign block URLs using a random key generated at startup instead of -signing_key_file, so that they can only be fetched from this process (for development)")
+	ticketLifetime   = flag.Duration("ticket_lifetime", time.Hour, "length of time for which the block URLs in a ticket can be fetched")
+
+	directURLs    = flag.Bool("direct_urls", false, "send clients directly to storage to read the parts of the data that are returned unchanged")
+	gcsSigningKey = flag.String("gcs_signing_key", "", "if set, signs direct GCS URLs using the service account JSON key in this file")
+
 	buckets = flag.String("buckets", "", "if set, restricts reads to a comma-separated list of buckets")
 
+	idConfig = flag.String("id_config", "", "if set, resolves IDs using the JSON configuration in this file instead of treating them as bucket/object paths")
+
+	localRoots = flag.String("local_roots", "", "if set, serves files from a comma-separated list of name=directory pairs instead of GCS")
+	httpRoots  = flag.String("http_roots", "", "if set, serves files from a comma-separated list of name=URL pairs instead of GCS")
+
+	// Credentials for S3 are read from the AWS_ACCESS_KEY_ID,
+	// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+	s3Endpoint = flag.String("s3_endpoint", "", "if set, serves objects from this S3 compatible endpoint instead of GCS")
+	s3Region   = flag.String("s3_region", "us-east-1", "region used to sign S3 requests")
+
+	serviceID        = flag.String("service_id", "", "service ID reported by /service-info, in reverse domain name notation")
+	serviceName      = flag.String("service_name", "", "service name reported by /service-info")
+	organizationName = flag.String("organization_name", "", "name of the organization reported by /service-info")
+	organizationURL  = flag.String("organization_url", "", "URL of the organization reported by /service-info")
+	contactURL       = flag.String("contact_url", "", "contact URL reported by /service-info")
+	environment      = flag.String("environment", "", "deployment environment reported by /service-info")
+
 	// Enable or disable anonymous usage tracking.
 	//
 	// If enabled, anonymous information about requests handled by the server is
@@ -55,18 +84,128 @@ func main() {
 		log.Fatalf("You must specify both -https_cert and -https_key in secure mode.")
 	}
 
-	newStorageClient := api.NewPublicClient
+	newStorage := api.NewPublicClient
 	if *secure {
-		newStorageClient = api.NewClientFromBearerToken
+		newStorage = api.NewClientFromBearerToken
+	}
+	var backends int
+	for _, flag := range []string{*localRoots, *httpRoots, *s3Endpoint} {
+		if flag != "" {
+			backends++
+		}
+	}
+	if backends > 1 {
+		log.Fatalf("You can only specify one of -local_roots, -http_roots and -s3_endpoint.")
+	}
+	if *secure && backends > 0 {
+		// These backends do not use the client's bearer token, so secure mode
+		// would no longer authenticate requests.
+		log.Fatalf("You cannot specify -local_roots, -http_roots or -s3_endpoint in secure mode.")
+	}
+	if *localRoots != "" {
+		roots, err := api.ParseRoots(*localRoots)
+		if err != nil {
+			log.Fatalf("Failed to parse -local_roots: %v", err)
+		}
+		local := api.NewLocalStorage(roots)
+		newStorage = func(*http.Request) (api.Storage, http.Header, error) {
+			return local, nil, nil
+		}
+	}
+
+	if *httpRoots != "" {
+		roots, err := api.ParseRoots(*httpRoots)
+		if err != nil {
+			log.Fatalf("Failed to parse -http_roots: %v", err)
+		}
+		web, err := api.NewHTTPStorage(roots, nil)
+		if err != nil {
+			log.Fatalf("Failed to configure HTTP storage: %v", err)
+		}
+		newStorage = func(*http.Request) (api.Storage, http.Header, error) {
+			return web, nil, nil
+		}
+	}
+	if *s3Endpoint != "" {
+		s3, err := api.NewS3Storage(api.S3Config{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+		if err != nil {
+			log.Fatalf("Failed to configure S3: %v", err)
+		}
+		newStorage = func(*http.Request) (api.Storage, http.Header, error) {
+			return s3, nil, nil
+		}
+	}
+
+	if *gcsSigningKey != "" {
+		email, key, err := readServiceAccountKey(*gcsSigningKey)
+		if err != nil {
+			log.Fatalf("Failed to read -gcs_signing_key: %v", err)
+		}
+		unsigned := newStorage
+		newStorage = func(req *http.Request) (api.Storage, http.Header, error) {
+			store, headers, err := unsigned(req)
+			if err != nil {
+				return nil, nil, err
+			}
+			return api.WithGCSSigningKey(store, email, key), headers, nil
+		}
 	}
 
-	server := api.NewServer(newStorageClient, *blockSize)
+	server := api.NewServer(newStorage, *blockSize)
+	if *directURLs {
+		server.EnableDirectURLs()
+	}
+	server.SetIndexCacheSize(*cacheSize)
+	server.SetTicketLifetime(*ticketLifetime)
+	switch {
+	case *signingKeyFile != "" && *randomSigningKey:
+		log.Fatalf("Only one of -signing_key_file and -random_signing_key may be set.")
+	case *signingKeyFile != "":
+		key, err := ioutil.ReadFile(*signingKeyFile)
+		if err != nil {
+			log.Fatalf("Failed to read -signing_key_file: %v", err)
+		}
+		if len(key) == 0 {
+			log.Fatalf("The -signing_key_file must not be empty.")
+		}
+		server.SetSigningKey(key)
+	case !*randomSigningKey:
+		log.Fatalf("A -signing_key_file is required (or -random_signing_key for a single server process).")
+	}
 	server.Export(http.DefaultServeMux)
 
 	if *buckets != "" {
 		server.Whitelist(strings.Split(*buckets, ","))
 	}
 
+	if *idConfig != "" {
+		f, err := os.Open(*idConfig)
+		if err != nil {
+			log.Fatalf("Failed to open -id_config: %v", err)
+		}
+		resolver, err := api.LoadConfigResolver(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Failed to load -id_config: %v", err)
+		}
+		server.SetIDResolver(resolver)
+	}
+
+	server.SetServiceInfo(api.ServiceInfo{
+		ID:               *serviceID,
+		Name:             *serviceName,
+		OrganizationName: *organizationName,
+		OrganizationURL:  *organizationURL,
+		ContactURL:       *contactURL,
+		Environment:      *environment,
+	})
+
 	handler := http.Handler(http.DefaultServeMux)
 	if *trackUsage {
 		log.Printf("Enabling anonymous usage tracking")
@@ -90,3 +229,23 @@ func main() {
 		}
 	}
 }
+
+// readServiceAccountKey returns the email address and private key of the
+// service account described by the JSON key file at path.
+func readServiceAccountKey(path string) (string, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	var key struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		return "", nil, fmt.Errorf("decoding key: %v", err)
+	}
+	if key.ClientEmail == "" || key.PrivateKey == "" {
+		return "", nil, fmt.Errorf("missing client_email or private_key")
+	}
+	return key.ClientEmail, []byte(key.PrivateKey), nil
+}
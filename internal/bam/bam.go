@@ -16,7 +16,7 @@
 package bam
 
 import (
-	"compress/gzip"
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,25 +31,15 @@ const (
 	baiMagic = "BAI\x01"
 	bamMagic = "BAM\x01"
 
-	// This ID is used as a virtual bin ID for (unused) chunk metadata.
-	metadataID = 37450
-
 	// This is just to prevent arbitrarily long allocations due to malformed
 	// data.  No reference name should be longer than this in practice.
 	maximumNameLength = 1024
-
-	// The size of each tiling window from the linear index, as specified in the
-	// SAM specification section 5.1.3.
-	linearWindowSize = 1 << 14
 )
 
 // GetReferenceID attempts to determine the ID for the named genomic reference
 // by reading BAM header data from bam.
 func GetReferenceID(bam io.Reader, reference string) (int32, error) {
-	bam, err := gzip.NewReader(bam)
-	if err != nil {
-		return 0, fmt.Errorf("opening archive: %v", err)
-	}
+	bam = bgzf.NewReader(bam)
 
 	if err := binary.ExpectBytes(bam, []byte(bamMagic)); err != nil {
 		return 0, fmt.Errorf("reading magic: %v", err)
@@ -74,7 +64,7 @@ func GetReferenceID(bam io.Reader, reference string) (int32, error) {
 			return 0, fmt.Errorf("invalid name length (%d bytes)", length)
 		}
 		name := make([]byte, length)
-		if _, err := bam.Read(name); err != nil {
+		if _, err := io.ReadFull(bam, name); err != nil {
 			return 0, fmt.Errorf("reading name: %v", err)
 		}
 		if string(name[:length-1]) == reference {
@@ -88,80 +78,55 @@ func GetReferenceID(bam io.Reader, reference string) (int32, error) {
 	return 0, fmt.Errorf("no reference named %q found", reference)
 }
 
-// Read reads index data from bai and returns a set of BGZF chunks covering
-// the header and all mapped reads that fall inside the specified region.  The
-// first chunk is always the BAM header.
-func Read(bai io.Reader, region genomics.Region) ([]*bgzf.Chunk, error) {
-	if err := binary.ExpectBytes(bai, []byte(baiMagic)); err != nil {
+// Index holds the contents of a BAI or CSI file so that it can be queried
+// repeatedly without being parsed again.
+type Index struct {
+	index interface {
+		Query(genomics.Region) []*bgzf.Chunk
+		Boundaries() []bgzf.Address
+	}
+}
+
+// ReadIndex reads and parses the index data from index, which may be either
+// a BAI file or a CSI file.  CSI files are needed for references longer than
+// 2^29 bases, which cannot be indexed using BAI.
+func ReadIndex(index io.Reader) (*Index, error) {
+	r := bufio.NewReader(index)
+	magic, err := r.Peek(len(baiMagic))
+	if err != nil {
 		return nil, fmt.Errorf("reading magic: %v", err)
 	}
+	if string(magic) != baiMagic {
+		// CSI files are BGZF compressed and so have no uncompressed magic.
+		csi, err := csi.ReadIndex(r)
+		if err != nil {
+			return nil, err
+		}
+		return &Index{csi}, nil
+	}
+	r.Discard(len(baiMagic))
 
 	var references int32
-	if err := binary.Read(bai, &references); err != nil {
+	if err := binary.Read(r, &references); err != nil {
 		return nil, fmt.Errorf("reading reference count: %v", err)
 	}
 
-	// BAM uses a 6 level (depth = 5) CSI binning scheme with a minimum width of 14 bits.
-	bins := csi.BinsForRange(region.Start, region.End, 14, 5)
-
-	header := &bgzf.Chunk{End: bgzf.LastAddress}
-	chunks := []*bgzf.Chunk{header}
-	for i := int32(0); i < references; i++ {
-		var binCount int32
-		if err := binary.Read(bai, &binCount); err != nil {
-			return nil, fmt.Errorf("reading bin count: %v", err)
-		}
-		var candidates []*bgzf.Chunk
-		for j := int32(0); j < binCount; j++ {
-			var bin struct {
-				ID     uint32
-				Chunks int32
-			}
-			if err := binary.Read(bai, &bin); err != nil {
-				return nil, fmt.Errorf("reading bin header: %v", err)
-			}
-
-			includeChunks := csi.RegionContainsBin(region, i, bin.ID, bins)
-			for k := int32(0); k < bin.Chunks; k++ {
-				var chunk bgzf.Chunk
-				if err := binary.Read(bai, &chunk); err != nil {
-					return nil, fmt.Errorf("reading chunk: %v", err)
-				}
-				if bin.ID == metadataID {
-					continue
-				}
-				if includeChunks {
-					candidates = append(candidates, &chunk)
-				}
-				if header.End > chunk.Start {
-					header.End = chunk.Start
-				}
-			}
-		}
-
-		var intervals int32
-		if err := binary.Read(bai, &intervals); err != nil {
-			return nil, fmt.Errorf("reading interval count: %v", err)
-		}
-		if intervals < 0 {
-			return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
-		}
-		offsets := make([]uint64, intervals)
-		if err := binary.Read(bai, &offsets); err != nil {
-			return nil, fmt.Errorf("reading offsets: %v", err)
-		}
+	linear, err := csi.ParseLinearIndex(r, references)
+	if err != nil {
+		return nil, err
+	}
+	return &Index{linear}, nil
+}
 
-		var firstReadOffset bgzf.Address
-		if index := int(region.Start / linearWindowSize); index < len(offsets) {
-			firstReadOffset = bgzf.Address(offsets[index])
-		}
+// Query returns a set of BGZF chunks covering the header and all mapped reads
+// that fall inside the specified region.  The first chunk is always the BAM
+// header.  The returned chunks may be modified by the caller.
+func (index *Index) Query(region genomics.Region) []*bgzf.Chunk {
+	return index.index.Query(region)
+}
 
-		for _, chunk := range candidates {
-			if chunk.End < firstReadOffset {
-				continue
-			}
-			chunks = append(chunks, chunk)
-		}
-	}
-	return chunks, nil
+// Boundaries returns the sorted addresses at which records are known to
+// start, which can be used to split chunks using bgzf.Split.
+func (index *Index) Boundaries() []bgzf.Address {
+	return index.index.Boundaries()
 }
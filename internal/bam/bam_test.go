@@ -16,7 +16,13 @@ package bam
 
 import (
 	"bytes"
+	"compress/gzip"
+	encoding "encoding/binary"
+	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"testing"
 
 	"github.com/googlegenomics/htsget/internal/bgzf"
@@ -120,7 +126,7 @@ func TestGetReferenceID_Errors(t *testing.T) {
 	}
 }
 
-func TestRead_ChunkCountAndHeaderSize(t *testing.T) {
+func TestIndex_ChunkCountAndHeaderSize(t *testing.T) {
 	testCases := []struct {
 		filename   string
 		chunks     int
@@ -137,10 +143,11 @@ func TestRead_ChunkCountAndHeaderSize(t *testing.T) {
 				t.Fatalf("Failed to open test data: %v", err)
 			}
 
-			chunks, err := Read(r, genomics.AllMappedReads)
+			index, err := ReadIndex(r)
 			if err != nil {
 				t.Fatalf("Failed to read test data: %v", err)
 			}
+			chunks := index.Query(genomics.AllMappedReads)
 
 			if got, want := len(chunks), tc.chunks; got != want {
 				t.Errorf("Wrong number of chunks: got %d, want %d", got, want)
@@ -152,7 +159,7 @@ func TestRead_ChunkCountAndHeaderSize(t *testing.T) {
 	}
 }
 
-func TestRead_Region(t *testing.T) {
+func TestIndex_QueryRegion(t *testing.T) {
 	testCases := []struct {
 		name   string
 		region genomics.Region
@@ -180,13 +187,375 @@ func TestRead_Region(t *testing.T) {
 			}
 			defer r.Close()
 
-			chunks, err := Read(r, tc.region)
+			index, err := ReadIndex(r)
 			if err != nil {
 				t.Fatalf("Failed to read test data: %v", err)
 			}
+			chunks := index.Query(tc.region)
 			if got, want := len(chunks), tc.chunks; got != want {
 				t.Fatalf("Wrong number of chunks: got %d, want %d", got, want)
 			}
 		})
 	}
 }
+
+func TestIndex_Query(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	index, err := ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse test data: %v", err)
+	}
+
+	regions := []genomics.Region{
+		genomics.AllMappedReads,
+		{ReferenceID: 19, Start: 62500000, End: 63500000},
+		{ReferenceID: 18},
+		{ReferenceID: 19, Start: 62500000, End: 63500000},
+	}
+	for _, region := range regions {
+		// The results must match those of a freshly parsed index.
+		fresh, err := ReadIndex(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to parse test data: %v", err)
+		}
+		want := fresh.Query(region)
+		got := index.Query(region)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%s): got %v, want %v", region, got, want)
+		}
+
+		// Modifying the results must not affect later queries.
+		for _, chunk := range got {
+			chunk.End = bgzf.LastAddress
+		}
+	}
+}
+
+func TestIndex_Boundaries(t *testing.T) {
+	for _, name := range []string{"multi-reference.bam.bai", "header-in-separate-chunk.bam.bai"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile("testdata/" + name)
+			if err != nil {
+				t.Fatalf("Failed to read test data: %v", err)
+			}
+			index, err := ReadIndex(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("Failed to parse test data: %v", err)
+			}
+
+			boundaries := index.Boundaries()
+			if len(boundaries) == 0 {
+				t.Fatalf("No boundaries")
+			}
+			for i := 1; i < len(boundaries); i++ {
+				if boundaries[i-1] >= boundaries[i] {
+					t.Errorf("Boundaries not sorted: %s >= %s", boundaries[i-1], boundaries[i])
+				}
+			}
+			// Every chunk in the index starts at a boundary.
+			for _, chunk := range index.Query(genomics.AllMappedReads)[1:] {
+				i := sort.Search(len(boundaries), func(i int) bool { return boundaries[i] >= chunk.Start })
+				if i == len(boundaries) || boundaries[i] != chunk.Start {
+					t.Errorf("Chunk %v does not start at a boundary", chunk)
+				}
+			}
+		})
+	}
+}
+
+func TestReadIndex_CSI(t *testing.T) {
+	// A CSI index for a single reference that is longer than BAI supports, with
+	// a record in the first bin and another record 600 Mbp along.
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		if err := encoding.Write(&buf, encoding.LittleEndian, v); err != nil {
+			t.Fatalf("Failed to write test data: %v", err)
+		}
+	}
+	buf.WriteString("CSI\x01")
+	write([]int32{14, 6, 0, 1, 2})
+	write(uint32(0))
+	write(uint64(0x1000000))
+	write(int32(1))
+	write([]bgzf.Address{0x1000000, 0x2000000})
+	write(uint32(74070))
+	write(uint64(0x3000000))
+	write(int32(1))
+	write([]bgzf.Address{0x3000000, 0x4000000})
+
+	block, err := bgzf.EncodeBlock(buf.Bytes())
+	if err != nil {
+		t.Fatalf("EncodeBlock() failed: %v", err)
+	}
+	index, err := ReadIndex(bytes.NewReader(block))
+	if err != nil {
+		t.Fatalf("ReadIndex() failed: %v", err)
+	}
+
+	header := &bgzf.Chunk{End: 0x1000000}
+	first := &bgzf.Chunk{Start: 0x1000000, End: 0x2000000}
+	last := &bgzf.Chunk{Start: 0x3000000, End: 0x4000000}
+	testCases := []struct {
+		name   string
+		region genomics.Region
+		chunks []*bgzf.Chunk
+	}{
+		{"all mapped reads", genomics.AllMappedReads, []*bgzf.Chunk{header, first, last}},
+		{"start of reference", genomics.Region{Start: 0, End: 1000}, []*bgzf.Chunk{header, first}},
+		{"past 512 Mbp", genomics.Region{Start: 600000000, End: 600001000}, []*bgzf.Chunk{header, last}},
+		{"other reference", genomics.Region{ReferenceID: 1}, []*bgzf.Chunk{header}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got, want := index.Query(tc.region), tc.chunks; !reflect.DeepEqual(got, want) {
+				t.Errorf("Query(%s): got %v, want %v", tc.region, got, want)
+			}
+		})
+	}
+}
+
+func TestIndex_QueryUnmapped(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/multi-reference.bam.bai")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	var mappedEnd bgzf.Address
+	index, err := ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	chunks := index.Query(genomics.AllMappedReads)
+	for _, chunk := range chunks {
+		if chunk.End > mappedEnd {
+			mappedEnd = chunk.End
+		}
+	}
+	header := chunks[0]
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		chunks []*bgzf.Chunk
+	}{
+		{"no unplaced reads", data, []*bgzf.Chunk{header}},
+		{"unplaced reads", append(data[:len(data)-8:len(data)-8], 1, 0, 0, 0, 0, 0, 0, 0),
+			[]*bgzf.Chunk{header, {Start: mappedEnd, End: bgzf.LastAddress}}},
+		{"unknown number of unplaced reads", data[:len(data)-8],
+			[]*bgzf.Chunk{header, {Start: mappedEnd, End: bgzf.LastAddress}}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			index, err := ReadIndex(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("ReadIndex() failed: %v", err)
+			}
+			if got, want := index.Query(genomics.UnmappedReads), tc.chunks; !reflect.DeepEqual(got, want) {
+				t.Errorf("Query(): got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReader_RoundTrip(t *testing.T) {
+	f, err := os.Open("testdata/multi-reference.bam")
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	data, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("Failed to decompress test data: %v", err)
+	}
+	body := data[headerLength(t, data):]
+
+	// Compress the records without the header, splitting records across blocks.
+	var compressed bytes.Buffer
+	for len(body) > 0 {
+		size := 1000
+		if size > len(body) {
+			size = len(body)
+		}
+		block, err := bgzf.EncodeBlock(body[:size])
+		if err != nil {
+			t.Fatalf("EncodeBlock() failed: %v", err)
+		}
+		compressed.Write(block)
+		body = body[size:]
+	}
+
+	r := NewReader(&compressed)
+	var encoded bytes.Buffer
+	w := NewWriter(&encoded)
+	count := 0
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read() failed: %v", err)
+		}
+		if record.End() <= record.Position {
+			t.Errorf("Wrong end for record %q: got %d, want more than %d", record.Name, record.End(), record.Position)
+		}
+		if err := w.Write(record); err != nil {
+			t.Fatalf("Write() failed: %v", err)
+		}
+		count++
+	}
+	if count == 0 {
+		t.Fatalf("No records read")
+	}
+	if got, want := encoded.Bytes(), data[headerLength(t, data):]; !bytes.Equal(got, want) {
+		t.Errorf("Records were not re-encoded exactly (got %d bytes, want %d)", len(got), len(want))
+	}
+}
+
+func TestReader_TruncatedRecord(t *testing.T) {
+	record, err := (&Record{ReferenceID: 1, Position: 100, Name: "r"}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	var stream bytes.Buffer
+	if err := NewWriter(&stream).WriteRaw(record); err != nil {
+		t.Fatalf("WriteRaw() failed: %v", err)
+	}
+
+	// Cut the record (including its block size) short at every offset.
+	for cut := 1; cut < stream.Len(); cut++ {
+		block, err := bgzf.EncodeBlock(stream.Bytes()[:cut])
+		if err != nil {
+			t.Fatalf("EncodeBlock() failed: %v", err)
+		}
+		r := bgzf.NewReader(bytes.NewReader(block))
+		got, err := NewReader(r).ReadRaw()
+		if err != ErrTruncatedRecord {
+			t.Fatalf("ReadRaw(cut %d): got error %v, want %v", cut, err, ErrTruncatedRecord)
+		}
+		if want := stream.Bytes()[:cut]; !bytes.Equal(got, want) {
+			t.Errorf("ReadRaw(cut %d): got %x, want %x", cut, got, want)
+		}
+	}
+}
+
+func TestRecord_End(t *testing.T) {
+	testCases := []struct {
+		name  string
+		cigar []CigarOp
+		end   int32
+	}{
+		{"no CIGAR", nil, 101},
+		{"matches", []CigarOp{75<<4 | CigarMatch}, 175},
+		{"clips and insertions", []CigarOp{5<<4 | CigarHardClip, 10<<4 | CigarSoftClip, 20<<4 | CigarEqual, 3<<4 | CigarInsertion, 20<<4 | CigarMismatch}, 140},
+		{"deletions and skips", []CigarOp{10<<4 | CigarMatch, 2<<4 | CigarDeletion, 1000<<4 | CigarSkipped, 10<<4 | CigarMatch}, 1122},
+		{"only insertions", []CigarOp{10<<4 | CigarInsertion}, 101},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			record := &Record{Position: 100, Cigar: tc.cigar}
+			if got, want := record.End(), tc.end; got != want {
+				t.Errorf("Wrong end: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRecord_Encode(t *testing.T) {
+	record := &Record{
+		ReferenceID:     1,
+		Position:        100,
+		MappingQuality:  60,
+		Bin:             4681,
+		Flag:            99,
+		NextReferenceID: 1,
+		NextPosition:    300,
+		TemplateLength:  275,
+		Name:            "read",
+		Cigar:           []CigarOp{3<<4 | CigarMatch},
+		Sequence:        []byte{0x12, 0x40},
+		Qualities:       []byte{30, 31, 32},
+		Tags:            []Tag{Tag("NMC\x00"), Tag("RGZgroup\x00"), Tag("XBBc\x02\x00\x00\x00\x01\x02")},
+	}
+	data, err := record.Encode()
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	decoded, err := DecodeRecord(data)
+	if err != nil {
+		t.Fatalf("DecodeRecord() failed: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, record) {
+		t.Errorf("Wrong decoded record: got %+v, want %+v", decoded, record)
+	}
+	if got, want := decoded.Tags[1].Name(), "RG"; got != want {
+		t.Errorf("Wrong tag name: got %q, want %q", got, want)
+	}
+
+	invalid := []*Record{
+		{Name: string(make([]byte, 255))},
+		{Sequence: []byte{0x12}, Qualities: []byte{1, 2, 3}},
+	}
+	for _, record := range invalid {
+		if _, err := record.Encode(); err == nil {
+			t.Errorf("Encode(%+v) succeeded", record)
+		}
+	}
+}
+
+func TestDecodeRecord_Errors(t *testing.T) {
+	valid, err := (&Record{Name: "r", Sequence: []byte{0x10}, Qualities: []byte{1}, Tags: []Tag{Tag("NMC\x00")}}).Encode()
+	if err != nil {
+		t.Fatalf("Encode() failed: %v", err)
+	}
+	modify := func(f func(data []byte) []byte) []byte {
+		return f(append([]byte(nil), valid...))
+	}
+
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"too short", valid[:recordHeaderSize-1]},
+		{"truncated", valid[:len(valid)-5]},
+		{"missing name", modify(func(data []byte) []byte { data[8] = 0; return data })},
+		{"unterminated name", modify(func(data []byte) []byte { data[recordHeaderSize+1] = 'x'; return data })},
+		{"negative sequence length", modify(func(data []byte) []byte { data[19] = 0x80; return data })},
+		{"unknown tag type", modify(func(data []byte) []byte { data[len(data)-2] = 'q'; return data })},
+		{"truncated tag", valid[:len(valid)-1]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := DecodeRecord(tc.data); err == nil {
+				t.Errorf("DecodeRecord() succeeded")
+			}
+		})
+	}
+}
+
+// headerLength returns the length of the header at the start of the
+// uncompressed BAM data.
+func headerLength(t *testing.T, data []byte) int {
+	offset := 4
+	next := func(length int) int {
+		if offset+length > len(data) {
+			t.Fatalf("Data ends inside the header")
+		}
+		offset += length
+		return int(encoding.LittleEndian.Uint32(data[offset-length:]))
+	}
+	next(next(4))
+	for references := next(4); references > 0; references-- {
+		next(next(4))
+		next(4)
+	}
+	return offset
+}
@@ -0,0 +1,368 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bam
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+)
+
+const (
+	// The fixed length part of a record, excluding the block size.
+	recordHeaderSize = 32
+
+	// This limits the memory used for a single (corrupt) record.
+	maximumRecordSize = 64 * 1024 * 1024
+)
+
+var errRecordTooShort = errors.New("record too short")
+
+// ErrTruncatedRecord is returned by Reader.ReadRaw when the data ends part way
+// through a record.
+var ErrTruncatedRecord = errors.New("data ends inside a record")
+
+// The CIGAR operation types.
+const (
+	CigarMatch = iota
+	CigarInsertion
+	CigarDeletion
+	CigarSkipped
+	CigarSoftClip
+	CigarHardClip
+	CigarPadding
+	CigarEqual
+	CigarMismatch
+)
+
+// CigarOp is a single CIGAR operation, encoded as in BAM files.
+type CigarOp uint32
+
+// Type returns the type of the operation (such as CigarMatch).
+func (op CigarOp) Type() int {
+	return int(op & 0xf)
+}
+
+// Length returns the number of bases that the operation applies to.
+func (op CigarOp) Length() int {
+	return int(op >> 4)
+}
+
+// ConsumesReference reports whether the operation covers reference bases.
+func (op CigarOp) ConsumesReference() bool {
+	switch op.Type() {
+	case CigarMatch, CigarDeletion, CigarSkipped, CigarEqual, CigarMismatch:
+		return true
+	}
+	return false
+}
+
+// Tag is a single encoded auxiliary field: the two character name, the type
+// and the value.
+type Tag []byte
+
+// Name returns the two character name of the tag.
+func (tag Tag) Name() string {
+	return string(tag[:2])
+}
+
+// Record is a BAM alignment record.  The variable length fields are kept in
+// their encoded form so that records are re-encoded exactly as they were read.
+type Record struct {
+	ReferenceID     int32
+	Position        int32
+	MappingQuality  uint8
+	Bin             uint16
+	Flag            uint16
+	NextReferenceID int32
+	NextPosition    int32
+	TemplateLength  int32
+
+	// Name is the read name without its terminating null character.
+	Name  string
+	Cigar []CigarOp
+
+	// Sequence holds the bases, packed two to a byte.  Qualities holds the
+	// quality of each base and so its length is the length of the sequence.
+	Sequence  []byte
+	Qualities []byte
+
+	Tags []Tag
+}
+
+// End returns the position after the last reference base covered by the
+// record.  As in samtools, a record that does not cover any reference bases
+// (such as an unmapped read) is treated as covering a single base.
+func (record *Record) End() int32 {
+	var length int32
+	for _, op := range record.Cigar {
+		if op.ConsumesReference() {
+			length += int32(op.Length())
+		}
+	}
+	if length == 0 {
+		length = 1
+	}
+	return record.Position + length
+}
+
+// DecodeRecord decodes a single record from data, which must not include the
+// leading block size.
+func DecodeRecord(data []byte) (*Record, error) {
+	if len(data) < recordHeaderSize {
+		return nil, errRecordTooShort
+	}
+
+	var (
+		nameLength = int(data[8])
+		cigarOps   = int(binary.LittleEndian.Uint16(data[12:]))
+		seqLength  = int(int32(binary.LittleEndian.Uint32(data[16:])))
+	)
+	if nameLength < 1 {
+		return nil, errors.New("missing name")
+	}
+	if seqLength < 0 {
+		return nil, fmt.Errorf("invalid sequence length (%d)", seqLength)
+	}
+	if recordHeaderSize+nameLength+4*cigarOps+(seqLength+1)/2+seqLength > len(data) {
+		return nil, errRecordTooShort
+	}
+	var (
+		name  = data[recordHeaderSize:]
+		cigar = name[nameLength:]
+		seq   = cigar[4*cigarOps:]
+		qual  = seq[(seqLength+1)/2:]
+		tags  = qual[seqLength:]
+	)
+	if name[nameLength-1] != 0 {
+		return nil, errors.New("name is not null terminated")
+	}
+
+	record := &Record{
+		ReferenceID:     int32(binary.LittleEndian.Uint32(data[0:])),
+		Position:        int32(binary.LittleEndian.Uint32(data[4:])),
+		MappingQuality:  data[9],
+		Bin:             binary.LittleEndian.Uint16(data[10:]),
+		Flag:            binary.LittleEndian.Uint16(data[14:]),
+		NextReferenceID: int32(binary.LittleEndian.Uint32(data[20:])),
+		NextPosition:    int32(binary.LittleEndian.Uint32(data[24:])),
+		TemplateLength:  int32(binary.LittleEndian.Uint32(data[28:])),
+		Name:            string(name[:nameLength-1]),
+		Sequence:        seq[:(seqLength+1)/2],
+		Qualities:       qual[:seqLength],
+	}
+	if cigarOps > 0 {
+		record.Cigar = make([]CigarOp, cigarOps)
+		for i := range record.Cigar {
+			record.Cigar[i] = CigarOp(binary.LittleEndian.Uint32(cigar[4*i:]))
+		}
+	}
+	for len(tags) > 0 {
+		size, err := tagSize(tags)
+		if err != nil {
+			return nil, err
+		}
+		record.Tags = append(record.Tags, Tag(tags[:size]))
+		tags = tags[size:]
+	}
+	return record, nil
+}
+
+// Encode returns the encoded record, without the leading block size.
+func (record *Record) Encode() ([]byte, error) {
+	if len(record.Name) > 254 {
+		return nil, fmt.Errorf("name too long (%d bytes)", len(record.Name))
+	}
+	if len(record.Cigar) > 0xffff {
+		return nil, fmt.Errorf("too many CIGAR operations (%d)", len(record.Cigar))
+	}
+	if got, want := len(record.Sequence), (len(record.Qualities)+1)/2; got != want {
+		return nil, fmt.Errorf("wrong packed sequence length: got %d, want %d", got, want)
+	}
+
+	size := recordHeaderSize + len(record.Name) + 1 + 4*len(record.Cigar) + len(record.Sequence) + len(record.Qualities)
+	for _, tag := range record.Tags {
+		size += len(tag)
+	}
+	data := make([]byte, recordHeaderSize, size)
+	binary.LittleEndian.PutUint32(data[0:], uint32(record.ReferenceID))
+	binary.LittleEndian.PutUint32(data[4:], uint32(record.Position))
+	data[8] = byte(len(record.Name) + 1)
+	data[9] = record.MappingQuality
+	binary.LittleEndian.PutUint16(data[10:], record.Bin)
+	binary.LittleEndian.PutUint16(data[12:], uint16(len(record.Cigar)))
+	binary.LittleEndian.PutUint16(data[14:], record.Flag)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(record.Qualities)))
+	binary.LittleEndian.PutUint32(data[20:], uint32(record.NextReferenceID))
+	binary.LittleEndian.PutUint32(data[24:], uint32(record.NextPosition))
+	binary.LittleEndian.PutUint32(data[28:], uint32(record.TemplateLength))
+
+	data = append(data, record.Name...)
+	data = append(data, 0)
+	for _, op := range record.Cigar {
+		var encoded [4]byte
+		binary.LittleEndian.PutUint32(encoded[:], uint32(op))
+		data = append(data, encoded[:]...)
+	}
+	data = append(data, record.Sequence...)
+	data = append(data, record.Qualities...)
+	for _, tag := range record.Tags {
+		data = append(data, tag...)
+	}
+	return data, nil
+}
+
+// Reader reads records from a BGZF compressed stream.
+type Reader struct {
+	r *bgzf.Reader
+}
+
+// NewReader returns a Reader that reads records from r, which must start with
+// a record (rather than the BAM header).  If r is a *bgzf.Reader, it is used
+// directly, so the records can start part way through a block.
+func NewReader(r io.Reader) *Reader {
+	if r, ok := r.(*bgzf.Reader); ok {
+		return &Reader{r}
+	}
+	return &Reader{bgzf.NewReader(r)}
+}
+
+// Address returns the address of the next record.
+func (r *Reader) Address() bgzf.Address {
+	return r.r.Address()
+}
+
+// Read returns the next record.  It returns io.EOF when there are no more
+// records.
+func (r *Reader) Read() (*Record, error) {
+	data, err := r.ReadRaw()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeRecord(data)
+}
+
+// ReadRaw returns the next encoded record, without the leading block size.
+// It returns io.EOF when there are no more records.  If the data ends part
+// way through a record, it returns the bytes of the record that were read,
+// including the block size, and ErrTruncatedRecord.
+func (r *Reader) ReadRaw() ([]byte, error) {
+	size := make([]byte, 4)
+	if n, err := io.ReadFull(r.r, size); err != nil {
+		switch err {
+		case io.EOF:
+			return nil, io.EOF
+		case io.ErrUnexpectedEOF:
+			return size[:n], ErrTruncatedRecord
+		}
+		return nil, fmt.Errorf("reading record size: %v", err)
+	}
+
+	length := binary.LittleEndian.Uint32(size)
+	if length < recordHeaderSize || length > maximumRecordSize {
+		return nil, fmt.Errorf("invalid record size (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	if n, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return append(size, data[:n]...), ErrTruncatedRecord
+		}
+		return nil, fmt.Errorf("reading record: %v", err)
+	}
+	return data, nil
+}
+
+// Writer writes encoded records, each preceded by its block size.  The
+// output is not compressed, so w is usually a BGZF writer.
+type Writer struct {
+	w io.Writer
+}
+
+// NewWriter returns a Writer that writes records to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// Write encodes record and writes it.
+func (w *Writer) Write(record *Record) error {
+	data, err := record.Encode()
+	if err != nil {
+		return fmt.Errorf("encoding record: %v", err)
+	}
+	return w.WriteRaw(data)
+}
+
+// WriteRaw writes the encoded record in data, which must not include the
+// leading block size.
+func (w *Writer) WriteRaw(data []byte) error {
+	var size [4]byte
+	binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+	if _, err := w.w.Write(size[:]); err != nil {
+		return fmt.Errorf("writing record size: %v", err)
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return fmt.Errorf("writing record: %v", err)
+	}
+	return nil
+}
+
+// tagSize returns the size of the encoded tag at the start of data.
+func tagSize(data []byte) (int, error) {
+	if len(data) < 4 {
+		return 0, errors.New("tag too short")
+	}
+
+	size := 3
+	switch data[2] {
+	case 'A', 'c', 'C':
+		size++
+	case 's', 'S':
+		size += 2
+	case 'i', 'I', 'f':
+		size += 4
+	case 'Z', 'H':
+		end := 3
+		for end < len(data) && data[end] != 0 {
+			end++
+		}
+		size = end + 1
+	case 'B':
+		if len(data) < 8 {
+			return 0, errors.New("array tag too short")
+		}
+		var width int
+		switch data[3] {
+		case 'c', 'C':
+			width = 1
+		case 's', 'S':
+			width = 2
+		case 'i', 'I', 'f':
+			width = 4
+		default:
+			return 0, fmt.Errorf("unknown array type %q", data[3])
+		}
+		count := int(binary.LittleEndian.Uint32(data[4:]))
+		size = 8 + width*count
+	default:
+		return 0, fmt.Errorf("unknown tag type %q", data[2])
+	}
+	if size > len(data) || size < 0 {
+		return 0, errors.New("tag extends past the end of the record")
+	}
+	return size, nil
+}
@@ -16,15 +16,12 @@
 package bcf
 
 import (
-	"bufio"
 	"compress/gzip"
-	"errors"
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
 
 	"github.com/googlegenomics/htsget/internal/binary"
+	"github.com/googlegenomics/htsget/internal/vcf"
 )
 
 const (
@@ -49,50 +46,5 @@ func GetReferenceID(bcf io.Reader, referenceName string) (int, error) {
 		return 0, fmt.Errorf("reading header length: %v", err)
 	}
 
-	scanner := bufio.NewScanner(io.LimitReader(gzr, int64(length)))
-	var id int
-	for scanner.Scan() {
-		if line := scanner.Text(); strings.HasPrefix(line, "##contig") {
-			if contigField(line, "ID") == referenceName {
-				return resolveID(line, id)
-			}
-			id++
-		} else if id > 0 {
-			break
-		}
-	}
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("scanning header: %v", err)
-	}
-	return 0, errors.New("reference name not found")
-}
-
-func contigField(input, name string) string {
-	field := name + "="
-	for {
-		start := strings.Index(input, field)
-		if start == -1 {
-			return ""
-		}
-		skip := start > 0 && !isDelimiter(input[start-1])
-		input = input[start+len(field):]
-		if skip {
-			continue
-		}
-		if end := strings.IndexAny(input, ",>"); end > 0 {
-			return input[:end]
-		}
-		return input
-	}
-}
-
-func isDelimiter(chr byte) bool {
-	return chr == ',' || chr == '<'
-}
-
-func resolveID(contig string, id int) (int, error) {
-	if idx := contigField(contig, "IDX"); idx != "" {
-		return strconv.Atoi(idx)
-	}
-	return id, nil
+	return vcf.ReferenceIDFromHeader(io.LimitReader(gzr, int64(length)), referenceName)
 }
@@ -53,47 +53,3 @@ func TestGetReferenceId(t *testing.T) {
 		})
 	}
 }
-
-func TestContigField(t *testing.T) {
-	testCases := []struct {
-		contig string
-		field  string
-		want   string
-	}{
-		{"##contig=<ID=chr1,length=248956422,IDX=0>", "ID", "chr1"},
-		{"##contig=<ID=chr10,length=248956422,IDX=0>", "length", "248956422"},
-		{"##contig=<ID=Y,length=248956422,IDX=0>", "IDX", "0"},
-		{"##contig=<length=248956422,IDX=0>", "OTHER", ""},
-		{"##contig=<ID=IDX,length=248956422,IDX=7>", "IDX", "7"},
-		{"##contig=<BADIDX=NO,length=248956422,IDX=7>", "IDX", "7"},
-	}
-
-	for i, tc := range testCases {
-		t.Run(string(i), func(t *testing.T) {
-			if got := contigField(tc.contig, tc.field); got != tc.want {
-				t.Fatalf("Wrong contigField response, want %v, got %v ", tc.want, got)
-			}
-		})
-	}
-}
-
-func TestResolveID(t *testing.T) {
-	testCases := []struct {
-		line string
-		want int
-	}{
-		{"##contig=<ID=chr1,length=248956422>", -1},
-		{"##contig=<ID=chr1,length=248956422,IDX=0>", 0},
-		{"##contig=<ID=chr1,length=248956422,IDX=7>", 7},
-		{"##contig=<ID=chr1,length=248956422,IDX=125>", 125},
-		{"##contig=<ID=chr1,IDX=125,length=248956422>", 125},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.line, func(t *testing.T) {
-			if got, _ := resolveID(tc.line, -1); got != tc.want {
-				t.Fatalf("Wrong getIdx response, want %d, got %d ", tc.want, got)
-			}
-		})
-	}
-}
@@ -21,6 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"sort"
 	"strconv"
 )
@@ -28,9 +29,24 @@ import (
 // LastAddress is the maximum valid BGZF address.
 const LastAddress = Address(0xffffffffffffffff)
 
+// EOFMarker is the empty block that marks the end of a BGZF file.
+var EOFMarker = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
 // MaximumBlockSize is the maximum BGZF block size.
 const MaximumBlockSize = 65536
 
+const (
+	// The size of the header of a block, up to and including the block size.
+	blockHeaderSize = 18
+
+	// Writers keep blocks below the maximum size so that incompressible data
+	// still fits in a single block.
+	maximumDataSize = 0xff00
+)
+
 // Address stores a BGZF "virtual address".  The lower 16 bits store the data
 // offset inside the uncompressed stream and upper 48 bits store the block
 // offset inside the compressed archive set.
@@ -73,8 +89,15 @@ func (v *Chunk) String() string {
 }
 
 // Merge attempts to merge any intersecting chunks in input.  Merge will not
-// join two chunks if their combined size could exceed sizeLimit.
+// join two chunks if their combined size could exceed sizeLimit, but chunks
+// that are already larger are left for Split to divide.  Chunks that are
+// entirely contained within another chunk are dropped and chunks that partly
+// overlap are trimmed to start where the previous chunk ends.
 func Merge(input []*Chunk, sizeLimit uint64) []*Chunk {
+	if len(input) == 0 {
+		return nil
+	}
+
 	sort.Slice(input, func(i, j int) bool {
 		return input[i].Start < input[j].Start
 	})
@@ -84,26 +107,117 @@ func Merge(input []*Chunk, sizeLimit uint64) []*Chunk {
 		output = merged[0]
 	)
 	for i := 1; i < len(input); i++ {
-		var size uint64
-		if input[i].End.BlockOffset() == output.Start.BlockOffset() {
-			size = uint64(input[i].End.DataOffset() - output.Start.DataOffset())
-		} else {
-			// Estimate using the maximum size for the last block.
-			size = input[i].End.BlockOffset() - output.Start.BlockOffset() + MaximumBlockSize
+		if input[i].End <= output.End {
+			// The chunk is already covered by the current output chunk.
+			continue
 		}
 
-		if input[i].Start <= output.End && size <= sizeLimit {
+		if input[i].Start <= output.End && size(output.Start, input[i].End) <= sizeLimit {
 			if output.End < input[i].End {
 				output.End = input[i].End
 			}
 		} else {
-			merged = append(merged, input[i])
-			output = merged[len(merged)-1]
+			chunk := input[i]
+			if chunk.Start < output.End {
+				// Only the part of the chunk that is not already covered by the
+				// current output chunk is kept, so no record is returned twice.
+				chunk = &Chunk{output.End, chunk.End}
+			}
+			merged = append(merged, chunk)
+			output = chunk
 		}
 	}
 	return merged
 }
 
+// Split divides any of input that could be larger than sizeLimit into parts
+// that are no larger than sizeLimit.  The chunks are only split at the sorted
+// addresses in boundaries, so a part may still exceed sizeLimit if there are
+// not enough boundaries inside a chunk.
+func Split(input []*Chunk, boundaries []Address, sizeLimit uint64) []*Chunk {
+	var split []*Chunk
+	for _, chunk := range input {
+		if size(chunk.Start, chunk.End) <= sizeLimit {
+			split = append(split, chunk)
+			continue
+		}
+
+		// The part is extended to each boundary in turn until it would become
+		// too large, when it is ended at the previous boundary.
+		start, last := chunk.Start, chunk.Start
+		i := sort.Search(len(boundaries), func(i int) bool {
+			return boundaries[i] > chunk.Start
+		})
+		for ; i < len(boundaries) && boundaries[i] < chunk.End; i++ {
+			if size(start, boundaries[i]) > sizeLimit && last > start {
+				split = append(split, &Chunk{start, last})
+				start = last
+			}
+			last = boundaries[i]
+		}
+		if size(start, chunk.End) > sizeLimit && last > start {
+			split = append(split, &Chunk{start, last})
+			start = last
+		}
+		split = append(split, &Chunk{start, chunk.End})
+	}
+	return split
+}
+
+// size returns the largest possible compressed size of the data from start
+// to end.  The maximum block size is used for the last block.
+func size(start, end Address) uint64 {
+	if end.BlockOffset() == start.BlockOffset() {
+		return uint64(end.DataOffset() - start.DataOffset())
+	}
+	return end.BlockOffset() - start.BlockOffset() + MaximumBlockSize
+}
+
+// ReadBlock reads a single BGZF block from r and returns it without
+// decompressing it.  It returns io.EOF if r has no more data.
+func ReadBlock(r io.Reader) ([]byte, error) {
+	header := make([]byte, blockHeaderSize)
+	size, err := readBlockHeader(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	block := make([]byte, size)
+	copy(block, header)
+	if _, err := io.ReadFull(r, block[blockHeaderSize:]); err != nil {
+		return nil, fmt.Errorf("reading block: %v", err)
+	}
+	return block, nil
+}
+
+// ReadBlockSize reads the header of a BGZF block from r and returns the size
+// of the whole (compressed) block.  Only the header is read, so the size of a
+// block can be found without reading its data.  It returns io.EOF if r has no
+// more data.
+func ReadBlockSize(r io.Reader) (int, error) {
+	return readBlockHeader(r, make([]byte, blockHeaderSize))
+}
+
+// readBlockHeader reads the header of a block from r into header, which must
+// be blockHeaderSize bytes long, and returns the size of the block.
+func readBlockHeader(r io.Reader, header []byte) (int, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		return 0, fmt.Errorf("reading block header: %v", err)
+	}
+	if header[0] != 0x1f || header[1] != 0x8b || header[12] != 'B' || header[13] != 'C' {
+		return 0, errors.New("invalid block header")
+	}
+
+	size := int(header[16]) | int(header[17])<<8 + 1
+	if size < blockHeaderSize {
+		return 0, fmt.Errorf("invalid block size (%d bytes)", size)
+	}
+	return size, nil
+}
+
 // DecodeBlock decodes a single BGZF block from r and returns the uncompressed
 // data and the original block size (or an error).  Note that DecodeBlock may
 // read bytes past the end of the block if r does not implement io.ByteReader.
@@ -156,3 +270,210 @@ func EncodeBlock(data []byte) ([]byte, error) {
 	encoded[17] = byte(bsize >> 8)
 	return encoded, nil
 }
+
+// Reader reads the decompressed data in a series of BGZF blocks, keeping track
+// of the address of the data.  Addresses are relative to the start of the
+// underlying reader.
+type Reader struct {
+	r io.Reader
+
+	// offset is the position of r.  The current block starts at blockOffset,
+	// has the compressed size blockSize and the decompressed contents data, of
+	// which the first dataOffset bytes have been read.
+	offset      uint64
+	blockOffset uint64
+	blockSize   uint64
+	data        []byte
+	dataOffset  int
+	err         error
+}
+
+// NewReader returns a Reader that reads from r, which must be positioned at
+// the start of a block.  Seek can only be used if r implements io.Seeker.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Read reads decompressed data into p.  It reads from at most one block at a
+// time and returns io.EOF at the end of the data.
+func (r *Reader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for r.dataOffset == len(r.data) {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.err = r.load(r.blockOffset + r.blockSize); r.err != nil {
+			return 0, r.err
+		}
+	}
+	n := copy(p, r.data[r.dataOffset:])
+	r.dataOffset += n
+	return n, nil
+}
+
+// Address returns the address of the next byte that will be read.  Once all
+// of the data in a block has been read, the address is that of the start of
+// the next block.
+func (r *Reader) Address() Address {
+	if r.dataOffset == len(r.data) {
+		return NewAddress(r.blockOffset+r.blockSize, 0)
+	}
+	return NewAddress(r.blockOffset, uint16(r.dataOffset))
+}
+
+// Seek moves the reader to address, so that the next call to Read returns the
+// data found there.
+func (r *Reader) Seek(address Address) error {
+	r.err = nil
+	if err := r.load(address.BlockOffset()); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("seeking to %s: %v", address, err)
+	}
+	if int(address.DataOffset()) > len(r.data) {
+		return fmt.Errorf("seeking to %s: data offset past the end of the block (%d bytes)", address, len(r.data))
+	}
+	r.dataOffset = int(address.DataOffset())
+	return nil
+}
+
+// load reads and decompresses the block at offset.
+func (r *Reader) load(offset uint64) error {
+	if offset != r.offset {
+		seeker, ok := r.r.(io.Seeker)
+		if !ok {
+			return errors.New("reader does not support seeking")
+		}
+		if _, err := seeker.Seek(int64(offset), io.SeekStart); err != nil {
+			return fmt.Errorf("seeking to offset %d: %v", offset, err)
+		}
+		r.offset = offset
+	}
+
+	block, err := ReadBlock(r.r)
+	if err != nil {
+		return err
+	}
+	r.offset += uint64(len(block))
+
+	data, _, err := DecodeBlock(bytes.NewReader(block))
+	if err != nil {
+		return err
+	}
+	r.blockOffset, r.blockSize = offset, uint64(len(block))
+	r.data, r.dataOffset = data, 0
+	return nil
+}
+
+// Writer compresses a stream of data into BGZF blocks.  Blocks are compressed
+// concurrently but written in order.
+type Writer struct {
+	w       io.Writer
+	workers int
+	buffer  []byte
+	pending []*pendingBlock
+	err     error
+}
+
+type pendingBlock struct {
+	encoded []byte
+	err     error
+	done    chan struct{}
+}
+
+// NewWriter returns a Writer that writes blocks to w, compressing up to
+// workers blocks at a time.  If workers is not positive, runtime.GOMAXPROCS(0)
+// is used.
+func NewWriter(w io.Writer, workers int) *Writer {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &Writer{w: w, workers: workers}
+}
+
+// Write buffers data and compresses it into blocks as they are filled.
+func (w *Writer) Write(data []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.buffer = append(w.buffer, data...)
+	for len(w.buffer) >= maximumDataSize {
+		block := append([]byte(nil), w.buffer[:maximumDataSize]...)
+		w.buffer = w.buffer[maximumDataSize:]
+		if w.err = w.compress(block); w.err != nil {
+			return 0, w.err
+		}
+	}
+	return len(data), nil
+}
+
+// Flush compresses any buffered data into a final block and waits until every
+// block has been written.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if len(w.buffer) > 0 {
+		block := w.buffer
+		w.buffer = nil
+		if w.err = w.compress(block); w.err != nil {
+			return w.err
+		}
+	}
+	for len(w.pending) > 0 {
+		if w.err = w.writeNext(); w.err != nil {
+			return w.err
+		}
+	}
+	return nil
+}
+
+// Close flushes the writer and writes the EOF marker.  It does not close the
+// underlying writer.
+func (w *Writer) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(EOFMarker); err != nil {
+		w.err = fmt.Errorf("writing EOF marker: %v", err)
+		return w.err
+	}
+	w.err = errors.New("writer is closed")
+	return nil
+}
+
+// compress starts compressing data on a new goroutine, first writing the
+// oldest blocks if too many are already pending.
+func (w *Writer) compress(data []byte) error {
+	block := &pendingBlock{done: make(chan struct{})}
+	go func() {
+		defer close(block.done)
+		block.encoded, block.err = EncodeBlock(data)
+	}()
+	w.pending = append(w.pending, block)
+
+	for len(w.pending) > w.workers {
+		if err := w.writeNext(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNext waits for the oldest pending block to be compressed and writes it.
+func (w *Writer) writeNext() error {
+	block := w.pending[0]
+	w.pending = w.pending[1:]
+
+	<-block.done
+	if block.err != nil {
+		return fmt.Errorf("encoding block: %v", block.err)
+	}
+	if _, err := w.w.Write(block.encoded); err != nil {
+		return fmt.Errorf("writing block: %v", err)
+	}
+	return nil
+}
@@ -16,8 +16,12 @@ package bgzf
 
 import (
 	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
 	"reflect"
 	"strings"
 	"testing"
@@ -141,6 +145,24 @@ func TestMerge(t *testing.T) {
 			"00000000-00008000,00008000-10000000",
 			"00000000-00008000,00008000-10000000",
 		},
+		{
+			"duplicate chunks, different blocks, too big",
+			1024,
+			"00000000-10000000,00000000-10000000",
+			"00000000-10000000",
+		},
+		{
+			"contained chunk, different blocks, too big",
+			1024,
+			"00000000-10000000,00008000-00010000",
+			"00000000-10000000",
+		},
+		{
+			"overlapping chunks, different blocks, too big",
+			1024,
+			"00000000-80000000,40000000-100000000",
+			"00000000-80000000,80000000-100000000",
+		},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
@@ -156,6 +178,90 @@ func TestMerge(t *testing.T) {
 	}
 }
 
+func TestMerge_Empty(t *testing.T) {
+	if got := Merge(nil, 1024); got != nil {
+		t.Errorf("Merge: got %s, want nil", got)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	testCases := []struct {
+		name       string
+		limit      uint64
+		input      string
+		boundaries string
+		split      string
+	}{
+		{
+			"small enough",
+			0x30000,
+			"0-200000000",
+			"100000000",
+			"0-200000000",
+		},
+		{
+			"no boundaries",
+			0x30000,
+			"0-500000000",
+			"",
+			"0-500000000",
+		},
+		{
+			"several parts",
+			0x30000,
+			"0-500000000",
+			"100000000,200000000,300000000,400000000",
+			"0-200000000,200000000-400000000,400000000-500000000",
+		},
+		{
+			"boundaries outside of the chunk",
+			0x30000,
+			"100000000-400000000",
+			"0,100000000,200000000,400000000,500000000",
+			"100000000-200000000,200000000-400000000",
+		},
+		{
+			"part larger than the limit",
+			0x30000,
+			"0-500000000",
+			"400000000",
+			"0-400000000,400000000-500000000",
+		},
+		{
+			"several chunks",
+			0x30000,
+			"0-10,100000000-500000000",
+			"300000000",
+			"0-10,100000000-300000000,300000000-500000000",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := parseChunkString(tc.input)
+			if err != nil {
+				t.Fatalf("Bad chunk string: %v", err)
+			}
+			var boundaries []Address
+			if tc.boundaries != "" {
+				for _, s := range strings.Split(tc.boundaries, ",") {
+					address, err := ParseAddress(s)
+					if err != nil {
+						t.Fatalf("Bad address: %v", err)
+					}
+					boundaries = append(boundaries, address)
+				}
+			}
+			want, err := parseChunkString(tc.split)
+			if err != nil {
+				t.Fatalf("Bad chunk string: %v", err)
+			}
+			if got := Split(input, boundaries, tc.limit); !reflect.DeepEqual(got, want) {
+				t.Errorf("Split: got %s, want %s", got, want)
+			}
+		})
+	}
+}
+
 func TestDecodeBlock(t *testing.T) {
 	// Read test data to memory and use a ByteReader so that the gzip reader
 	// doesn't read too many bytes (it does if the reader only implements Read).
@@ -189,6 +295,233 @@ func TestDecodeBlock(t *testing.T) {
 	}
 }
 
+func TestReadBlock(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	r := bytes.NewReader(input)
+
+	for i, size := range []int{223, 420, 28} {
+		block, err := ReadBlock(r)
+		if err != nil {
+			t.Fatalf("Failed to read block %d: %v", i, err)
+		}
+		if got, want := len(block), size; got != want {
+			t.Errorf("Wrong block %d size: got %d, want %d", i, got, want)
+		}
+	}
+	if _, err := ReadBlock(r); err != io.EOF {
+		t.Errorf("Wrong error at the end of the data: got %v, want %v", err, io.EOF)
+	}
+
+	errorCases := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated header", input[:10]},
+		{"truncated block", input[:100]},
+		{"not a block", input[1:]},
+	}
+	for _, tc := range errorCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadBlock(bytes.NewReader(tc.data)); err == nil || err == io.EOF {
+				t.Errorf("ReadBlock() returned %v, want an error", err)
+			}
+		})
+	}
+}
+
+func TestReadBlockSize(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	var offset int
+	for i, want := range []int{223, 420, 28} {
+		got, err := ReadBlockSize(bytes.NewReader(input[offset:]))
+		if err != nil {
+			t.Fatalf("Failed to read block %d size: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("Wrong block %d size: got %d, want %d", i, got, want)
+		}
+		offset += got
+	}
+	if _, err := ReadBlockSize(bytes.NewReader(input[offset:])); err != io.EOF {
+		t.Errorf("Wrong error at the end of the data: got %v, want %v", err, io.EOF)
+	}
+	if _, err := ReadBlockSize(bytes.NewReader(input[1:])); err == nil || err == io.EOF {
+		t.Errorf("ReadBlockSize() returned %v, want an error", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	input, err := ioutil.ReadFile("testdata/tiny.bam")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	gzr, err := gzip.NewReader(bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	want, err := ioutil.ReadAll(gzr)
+	if err != nil {
+		t.Fatalf("Failed to decompress test data: %v", err)
+	}
+
+	got, err := ioutil.ReadAll(NewReader(bytes.NewReader(input)))
+	if err != nil {
+		t.Fatalf("Failed to read data: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Wrong data: got %d bytes, want %d bytes", len(got), len(want))
+	}
+
+	r := NewReader(bytes.NewReader(input))
+	addresses := []struct {
+		read    int
+		address Address
+	}{
+		{0, NewAddress(0, 0)},
+		{100, NewAddress(0, 100)},
+		{196, NewAddress(223, 0)},
+		{10, NewAddress(223, 10)},
+		{817, NewAddress(643, 0)},
+	}
+	for _, tc := range addresses {
+		if _, err := io.ReadFull(r, make([]byte, tc.read)); err != nil {
+			t.Fatalf("Failed to read %d bytes: %v", tc.read, err)
+		}
+		if got, want := r.Address(), tc.address; got != want {
+			t.Errorf("Wrong address: got %s, want %s", got, want)
+		}
+	}
+
+	seeks := []struct {
+		address Address
+		offset  int
+	}{
+		{NewAddress(223, 100), 396},
+		{NewAddress(0, 5), 5},
+		{NewAddress(0, 296), 296},
+	}
+	for _, tc := range seeks {
+		if err := r.Seek(tc.address); err != nil {
+			t.Fatalf("Seek(%s) failed: %v", tc.address, err)
+		}
+		data := make([]byte, 10)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatalf("Failed to read after seeking to %s: %v", tc.address, err)
+		}
+		if got, want := data, want[tc.offset:tc.offset+10]; !bytes.Equal(got, want) {
+			t.Errorf("Wrong data at %s: got %x, want %x", tc.address, got, want)
+		}
+	}
+
+	for _, address := range []Address{NewAddress(223, 900), NewAddress(10, 0), NewAddress(1000, 0)} {
+		if err := r.Seek(address); err == nil {
+			t.Errorf("Seek(%s) succeeded", address)
+		}
+	}
+	stream := NewReader(ioutil.NopCloser(bytes.NewReader(input)))
+	if err := stream.Seek(NewAddress(223, 0)); err == nil {
+		t.Errorf("Seek() succeeded without an io.Seeker")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	// Mix compressible and incompressible data so that blocks of the maximum
+	// size are written.
+	random := make([]byte, 300000)
+	rand.New(rand.NewSource(1)).Read(random)
+	data := append(bytes.Repeat([]byte("ACGT"), 100000), random...)
+
+	for _, workers := range []int{0, 1, 3} {
+		t.Run(fmt.Sprintf("%d workers", workers), func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf, workers)
+			for remaining := data; len(remaining) > 0; {
+				size := 12345
+				if size > len(remaining) {
+					size = len(remaining)
+				}
+				if _, err := w.Write(remaining[:size]); err != nil {
+					t.Fatalf("Write() failed: %v", err)
+				}
+				remaining = remaining[size:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() failed: %v", err)
+			}
+			if _, err := w.Write(data[:1]); err == nil {
+				t.Errorf("Write() succeeded after Close()")
+			}
+
+			encoded := buf.Bytes()
+			if !bytes.HasSuffix(encoded, EOFMarker) {
+				t.Errorf("Data does not end with the EOF marker")
+			}
+			for r := bytes.NewReader(encoded); ; {
+				block, err := ReadBlock(r)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("ReadBlock() failed: %v", err)
+				}
+				if len(block) > MaximumBlockSize {
+					t.Errorf("Block too large: got %d bytes, want at most %d", len(block), MaximumBlockSize)
+				}
+			}
+
+			decoded, err := ioutil.ReadAll(NewReader(bytes.NewReader(encoded)))
+			if err != nil {
+				t.Fatalf("Failed to read data: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Errorf("Wrong data: got %d bytes, want %d bytes", len(decoded), len(data))
+			}
+		})
+	}
+}
+
+func TestWriter_Flush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, 2)
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush() failed: %v", err)
+	}
+	if bytes.HasSuffix(buf.Bytes(), EOFMarker) {
+		t.Errorf("Flush() wrote the EOF marker")
+	}
+	decoded, _, err := DecodeBlock(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeBlock() failed: %v", err)
+	}
+	if got, want := string(decoded), "data"; got != want {
+		t.Errorf("Wrong data: got %q, want %q", got, want)
+	}
+
+	failing := NewWriter(failingWriter{}, 2)
+	if _, err := failing.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() failed: %v", err)
+	}
+	if err := failing.Flush(); err == nil {
+		t.Errorf("Flush() succeeded with a failing writer")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
 func TestEncodeBlock_ValidInputs(t *testing.T) {
 	testCases := []struct {
 		name       string
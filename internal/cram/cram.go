@@ -0,0 +1,390 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cram provides support for parsing CRAM files and their CRAI indexes
+// (http://samtools.github.io/hts-specs/CRAMv3.pdf).
+package cram
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+	"github.com/googlegenomics/htsget/internal/genomics"
+	"github.com/googlegenomics/htsget/internal/sam"
+)
+
+const (
+	cramMagic = "CRAM"
+
+	// The file definition is the magic followed by the major and minor format
+	// numbers and a 20 byte file ID.
+	fileDefinitionLength = len(cramMagic) + 2 + 20
+
+	// These are the only block compression methods that are used for the SAM
+	// header in practice.
+	rawMethod  = 0
+	gzipMethod = 1
+
+	// This is just to prevent arbitrarily large allocations due to malformed
+	// data.
+	maximumHeaderLength = 1 << 26
+)
+
+var (
+	// The EOF containers are defined in section 9 of the CRAM specification.
+	eofContainerV2 = []byte{
+		0x0b, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x0f, 0xe0, 0x45, 0x4f, 0x46, 0x00, 0x00, 0x00,
+		0x00, 0x01, 0x00, 0x00, 0x01, 0x00, 0x06, 0x06,
+		0x01, 0x00, 0x01, 0x00, 0x01, 0x00,
+	}
+	eofContainerV3 = []byte{
+		0x0f, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff,
+		0x0f, 0xe0, 0x45, 0x4f, 0x46, 0x00, 0x00, 0x00,
+		0x00, 0x01, 0x00, 0x05, 0xbd, 0xd9, 0x4f, 0x00,
+		0x01, 0x00, 0x06, 0x06, 0x01, 0x00, 0x01, 0x00,
+		0x01, 0x00, 0xee, 0x63, 0x01, 0x4b,
+	}
+)
+
+// Header describes the file definition and header container of a CRAM file.
+type Header struct {
+	// MajorVersion and MinorVersion specify the CRAM format version.
+	MajorVersion, MinorVersion uint8
+	// Text contains the SAM header text.
+	Text []byte
+	// Length is the combined size of the file definition and header container,
+	// which is also the offset of the first data container.
+	Length int64
+}
+
+// EOF returns the EOF container that terminates a file with this header's
+// format version.
+func (header *Header) EOF() ([]byte, error) {
+	switch header.MajorVersion {
+	case 2:
+		return eofContainerV2, nil
+	case 3:
+		return eofContainerV3, nil
+	}
+	return nil, fmt.Errorf("unsupported CRAM version %d.%d", header.MajorVersion, header.MinorVersion)
+}
+
+// ReadHeader reads the file definition and header container from cram.
+func ReadHeader(cram io.Reader) (*Header, error) {
+	r := bufio.NewReader(cram)
+	if err := binary.ExpectBytes(r, []byte(cramMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var header Header
+	if err := binary.Read(r, &header.MajorVersion); err != nil {
+		return nil, fmt.Errorf("reading major version: %v", err)
+	}
+	if err := binary.Read(r, &header.MinorVersion); err != nil {
+		return nil, fmt.Errorf("reading minor version: %v", err)
+	}
+	if _, err := header.EOF(); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, r, 20); err != nil {
+		return nil, fmt.Errorf("reading file ID: %v", err)
+	}
+
+	counter := &countingReader{r: r}
+	length, err := readContainerHeader(counter, header.MajorVersion)
+	if err != nil {
+		return nil, fmt.Errorf("reading header container: %v", err)
+	}
+	header.Length = int64(fileDefinitionLength) + counter.n + int64(length)
+
+	text, err := readHeaderBlock(r, header.MajorVersion)
+	if err != nil {
+		return nil, fmt.Errorf("reading header block: %v", err)
+	}
+	header.Text = text
+	return &header, nil
+}
+
+// GetReferenceID attempts to determine the ID for the named genomic reference
+// by reading the SAM header stored in cram.
+func GetReferenceID(cram io.Reader, reference string) (int32, error) {
+	header, err := ReadHeader(cram)
+	if err != nil {
+		return 0, err
+	}
+	return sam.GetReferenceID(bytes.NewReader(header.Text), reference)
+}
+
+// ReadContainerSize reads a container header from r and returns the total size
+// of the container, including the header itself.
+func ReadContainerSize(r io.Reader, majorVersion uint8) (int64, error) {
+	counter := &countingReader{r: bufio.NewReader(r)}
+	length, err := readContainerHeader(counter, majorVersion)
+	if err != nil {
+		return 0, err
+	}
+	return counter.n + int64(length), nil
+}
+
+// readContainerHeader reads a container header from r and returns the length
+// of the data that follows it.
+func readContainerHeader(r byteReader, majorVersion uint8) (int32, error) {
+	var length int32
+	if err := binary.Read(r, &length); err != nil {
+		return 0, fmt.Errorf("reading length: %v", err)
+	}
+	if length < 0 {
+		return 0, fmt.Errorf("invalid container length (%d bytes)", length)
+	}
+	// Reference ID, start, span and record count.
+	for i := 0; i < 4; i++ {
+		if _, err := readITF8(r); err != nil {
+			return 0, fmt.Errorf("reading container field: %v", err)
+		}
+	}
+	// Record counter and base count.
+	for i := 0; i < 2; i++ {
+		if _, err := readLTF8(r); err != nil {
+			return 0, fmt.Errorf("reading container counter: %v", err)
+		}
+	}
+	if _, err := readITF8(r); err != nil {
+		return 0, fmt.Errorf("reading block count: %v", err)
+	}
+	landmarks, err := readITF8(r)
+	if err != nil {
+		return 0, fmt.Errorf("reading landmark count: %v", err)
+	}
+	for i := int32(0); i < landmarks; i++ {
+		if _, err := readITF8(r); err != nil {
+			return 0, fmt.Errorf("reading landmark: %v", err)
+		}
+	}
+	if majorVersion >= 3 {
+		var crc uint32
+		if err := binary.Read(r, &crc); err != nil {
+			return 0, fmt.Errorf("reading checksum: %v", err)
+		}
+	}
+	return length, nil
+}
+
+// readHeaderBlock reads the block that holds the SAM header text from r.
+func readHeaderBlock(r byteReader, majorVersion uint8) ([]byte, error) {
+	var method, contentType uint8
+	if err := binary.Read(r, &method); err != nil {
+		return nil, fmt.Errorf("reading compression method: %v", err)
+	}
+	if err := binary.Read(r, &contentType); err != nil {
+		return nil, fmt.Errorf("reading content type: %v", err)
+	}
+	if _, err := readITF8(r); err != nil {
+		return nil, fmt.Errorf("reading content ID: %v", err)
+	}
+	compressedSize, err := readITF8(r)
+	if err != nil {
+		return nil, fmt.Errorf("reading compressed size: %v", err)
+	}
+	if _, err := readITF8(r); err != nil {
+		return nil, fmt.Errorf("reading raw size: %v", err)
+	}
+	if compressedSize < 0 || compressedSize > maximumHeaderLength {
+		return nil, fmt.Errorf("invalid block size (%d bytes)", compressedSize)
+	}
+
+	data := io.Reader(io.LimitReader(r, int64(compressedSize)))
+	switch method {
+	case rawMethod:
+	case gzipMethod:
+		gzr, err := gzip.NewReader(data)
+		if err != nil {
+			return nil, fmt.Errorf("initializing gzip reader: %v", err)
+		}
+		defer gzr.Close()
+		data = gzr
+	default:
+		return nil, fmt.Errorf("unsupported compression method %d", method)
+	}
+
+	var length int32
+	if err := binary.Read(data, &length); err != nil {
+		return nil, fmt.Errorf("reading header length: %v", err)
+	}
+	if length < 0 || length > maximumHeaderLength {
+		return nil, fmt.Errorf("invalid header length (%d bytes)", length)
+	}
+	text := make([]byte, length)
+	if _, err := io.ReadFull(data, text); err != nil {
+		return nil, fmt.Errorf("reading header text: %v", err)
+	}
+	return text, nil
+}
+
+// Index holds the slice entries from a CRAI index.
+type Index struct {
+	entries []entry
+}
+
+type entry struct {
+	referenceID  int32
+	start, span  int64
+	container    int64
+	slice, bytes int64
+}
+
+// ReadIndex reads the gzip compressed CRAI index from crai.
+func ReadIndex(crai io.Reader) (*Index, error) {
+	gzr, err := gzip.NewReader(crai)
+	if err != nil {
+		return nil, fmt.Errorf("initializing gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	var index Index
+	scanner := bufio.NewScanner(gzr)
+	for line := 1; scanner.Scan(); line++ {
+		if scanner.Text() == "" {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("line %d: expected 6 fields, found %d", line, len(fields))
+		}
+		var values [6]int64
+		for i, field := range fields {
+			v, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: parsing field %d: %v", line, i+1, err)
+			}
+			values[i] = v
+		}
+		index.entries = append(index.entries, entry{
+			referenceID: int32(values[0]),
+			start:       values[1],
+			span:        values[2],
+			container:   values[3],
+			slice:       values[4],
+			bytes:       values[5],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading index: %v", err)
+	}
+	return &index, nil
+}
+
+// LastContainer returns the offset of the last container listed in the index
+// or zero if the index is empty.
+func (index *Index) LastContainer() int64 {
+	var last int64
+	for _, entry := range index.entries {
+		if entry.container > last {
+			last = entry.container
+		}
+	}
+	return last
+}
+
+// Chunks returns a block aligned chunk for each container that holds records
+// from the specified region, where end is the offset at which the last
+// container finishes.  If the region does not specify a reference, every
+// container (including those holding unmapped reads) is returned.
+func (index *Index) Chunks(region genomics.Region, end int64) []*bgzf.Chunk {
+	offsets := make(map[int64]bool)
+	for _, entry := range index.entries {
+		offsets[entry.container] = true
+	}
+	var sorted []int64
+	for offset := range offsets {
+		sorted = append(sorted, offset)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	next := make(map[int64]int64)
+	for i, offset := range sorted {
+		if i+1 < len(sorted) {
+			next[offset] = sorted[i+1]
+		} else {
+			next[offset] = end
+		}
+	}
+
+	var chunks []*bgzf.Chunk
+	selected := make(map[int64]bool)
+	for _, entry := range index.entries {
+		if selected[entry.container] || !entry.overlaps(region) {
+			continue
+		}
+		selected[entry.container] = true
+		chunks = append(chunks, &bgzf.Chunk{
+			Start: bgzf.NewAddress(uint64(entry.container), 0),
+			End:   bgzf.NewAddress(uint64(next[entry.container]), 0),
+		})
+	}
+	return chunks
+}
+
+func (e *entry) overlaps(region genomics.Region) bool {
+	// Containers of unplaced unmapped reads have a reference ID of -1.
+	if region.ReferenceID == genomics.UnmappedReferenceID {
+		return e.referenceID == -1
+	}
+	if region.ReferenceID < 0 {
+		return true
+	}
+	if e.referenceID != region.ReferenceID {
+		return false
+	}
+	// Alignment starts in the index are one-based.
+	start := e.start - 1
+	if region.End > 0 && start >= int64(region.End) {
+		return false
+	}
+	return start+e.span > int64(region.Start)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r byteReader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
@@ -0,0 +1,251 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package cram
+
+import (
+	"bytes"
+	"hash/crc32"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+func TestReadITF8(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input []byte
+		want  int32
+	}{
+		{"one byte", []byte{0x7f}, 127},
+		{"two bytes", []byte{0x80, 0xff}, 255},
+		{"three bytes", []byte{0xc1, 0x00, 0x00}, 0x10000},
+		{"four bytes", []byte{0xe1, 0x00, 0x00, 0x00}, 0x1000000},
+		{"five bytes", []byte{0xf1, 0x00, 0x00, 0x00, 0x0f}, 0x1000000f},
+		{"negative one", []byte{0xff, 0xff, 0xff, 0xff, 0x0f}, -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(tc.input)
+			got, err := readITF8(r)
+			if err != nil {
+				t.Fatalf("readITF8() returned error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("readITF8(): got %d, want %d", got, tc.want)
+			}
+			if r.Len() != 0 {
+				t.Errorf("readITF8(): %d bytes left unread", r.Len())
+			}
+		})
+	}
+}
+
+func TestReadLTF8(t *testing.T) {
+	testCases := []struct {
+		name  string
+		input []byte
+		want  int64
+	}{
+		{"one byte", []byte{0x7f}, 127},
+		{"two bytes", []byte{0x80, 0xff}, 255},
+		{"five bytes", []byte{0xf1, 0x00, 0x00, 0x00, 0x00}, 0x100000000},
+		{"eight bytes", []byte{0xfe, 0x01, 0, 0, 0, 0, 0, 0}, 0x1000000000000},
+		{"nine bytes", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, -1},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := bytes.NewReader(tc.input)
+			got, err := readLTF8(r)
+			if err != nil {
+				t.Fatalf("readLTF8() returned error: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("readLTF8(): got %d, want %d", got, tc.want)
+			}
+			if r.Len() != 0 {
+				t.Errorf("readLTF8(): %d bytes left unread", r.Len())
+			}
+		})
+	}
+}
+
+func TestEOFContainers(t *testing.T) {
+	testCases := []struct {
+		version uint8
+		size    int64
+	}{
+		{2, 30},
+		{3, 38},
+	}
+	for _, tc := range testCases {
+		header := &Header{MajorVersion: tc.version}
+		eof, err := header.EOF()
+		if err != nil {
+			t.Fatalf("EOF() returned error for version %d: %v", tc.version, err)
+		}
+		size, err := ReadContainerSize(bytes.NewReader(eof), tc.version)
+		if err != nil {
+			t.Fatalf("ReadContainerSize() returned error for version %d: %v", tc.version, err)
+		}
+		if got, want := size, tc.size; got != want {
+			t.Errorf("Wrong EOF container size for version %d: got %d, want %d", tc.version, got, want)
+		}
+		if got, want := int64(len(eof)), tc.size; got != want {
+			t.Errorf("Wrong EOF container length for version %d: got %d, want %d", tc.version, got, want)
+		}
+	}
+
+	// Version 3 containers and blocks end with a CRC32 of their contents.
+	if got, want := crc32.ChecksumIEEE(eofContainerV3[:19]), uint32(0x4fd9bd05); got != want {
+		t.Errorf("Wrong container checksum: got %08x, want %08x", got, want)
+	}
+	if got, want := crc32.ChecksumIEEE(eofContainerV3[23:34]), uint32(0x4b0163ee); got != want {
+		t.Errorf("Wrong block checksum: got %08x, want %08x", got, want)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	r, err := os.Open("testdata/sample.cram")
+	if err != nil {
+		t.Fatalf("Failed to open test data: %v", err)
+	}
+	defer r.Close()
+
+	header, err := ReadHeader(r)
+	if err != nil {
+		t.Fatalf("ReadHeader() returned error: %v", err)
+	}
+	if got, want := header.MajorVersion, uint8(3); got != want {
+		t.Errorf("Wrong major version: got %d, want %d", got, want)
+	}
+	if got, want := header.Length, int64(123); got != want {
+		t.Errorf("Wrong header length: got %d, want %d", got, want)
+	}
+	if !bytes.Contains(header.Text, []byte("@SQ\tSN:chr2")) {
+		t.Errorf("Header text is missing references: %q", header.Text)
+	}
+}
+
+func TestReadHeader_Errors(t *testing.T) {
+	testCases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"wrong magic", []byte("BAM\x01")},
+		{"unsupported version", append([]byte("CRAM\x01\x00"), make([]byte, 20)...)},
+		{"truncated file ID", []byte("CRAM\x03\x00")},
+		{"missing header container", append([]byte("CRAM\x03\x00"), make([]byte, 20)...)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadHeader(bytes.NewReader(tc.data)); err == nil {
+				t.Fatalf("ReadHeader(): expected error, not success")
+			}
+		})
+	}
+}
+
+func TestGetReferenceID(t *testing.T) {
+	testCases := []struct {
+		name string
+		id   int32
+		err  bool
+	}{
+		{"chr1", 0, false},
+		{"chr2", 1, false},
+		{"chr3", 0, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/sample.cram")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			id, err := GetReferenceID(r, tc.name)
+			if (err != nil) != tc.err {
+				t.Fatalf("GetReferenceID() returned unexpected error: %v", err)
+			}
+			if id != tc.id {
+				t.Fatalf("Wrong reference ID: got %d, want %d", id, tc.id)
+			}
+		})
+	}
+}
+
+func TestIndex_Chunks(t *testing.T) {
+	const end = 8741
+	testCases := []struct {
+		name   string
+		region genomics.Region
+		want   [][2]uint64
+	}{
+		{"all reads", genomics.AllMappedReads, [][2]uint64{
+			{123, 1353}, {1353, 2585}, {2585, 3817}, {3817, 5049}, {5049, 6279}, {6279, 7511}, {7511, end},
+		}},
+		{"chr1, all reads", genomics.Region{ReferenceID: 0}, [][2]uint64{
+			{123, 1353}, {1353, 2585}, {2585, 3817}, {3817, 5049},
+		}},
+		{"chr1, one container", genomics.Region{ReferenceID: 0, Start: 20000, End: 20001}, [][2]uint64{
+			{1353, 2585},
+		}},
+		{"chr1, region spanning containers", genomics.Region{ReferenceID: 0, Start: 19999, End: 40001}, [][2]uint64{
+			{123, 1353}, {1353, 2585}, {2585, 3817},
+		}},
+		{"chr1, zero end", genomics.Region{ReferenceID: 0, Start: 70000}, [][2]uint64{
+			{3817, 5049},
+		}},
+		{"chr2, last mapped container", genomics.Region{ReferenceID: 1, Start: 40000}, [][2]uint64{
+			{6279, 7511},
+		}},
+		{"chr2, past the end", genomics.Region{ReferenceID: 1, Start: 60000}, nil},
+		{"unplaced unmapped reads", genomics.UnmappedReads, [][2]uint64{
+			{7511, end},
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/sample.cram.crai")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			index, err := ReadIndex(r)
+			if err != nil {
+				t.Fatalf("ReadIndex() returned error: %v", err)
+			}
+			if got, want := index.LastContainer(), int64(7511); got != want {
+				t.Errorf("Wrong last container: got %d, want %d", got, want)
+			}
+
+			var want []*bgzf.Chunk
+			for _, offsets := range tc.want {
+				want = append(want, &bgzf.Chunk{
+					Start: bgzf.NewAddress(offsets[0], 0),
+					End:   bgzf.NewAddress(offsets[1], 0),
+				})
+			}
+			if got := index.Chunks(tc.region, end); !reflect.DeepEqual(got, want) {
+				t.Errorf("Chunks(): got %v, want %v", got, want)
+			}
+		})
+	}
+}
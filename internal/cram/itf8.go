@@ -0,0 +1,86 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cram
+
+import (
+	"io"
+)
+
+// readITF8 reads a single ITF8 encoded integer from r, as described in section
+// 2.3 of the CRAM specification.
+func readITF8(r io.ByteReader) (int32, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for mask := byte(0x80); count < 4 && first&mask != 0; mask >>= 1 {
+		count++
+	}
+	if count == 4 {
+		// The last byte only contributes its lower 4 bits.
+		value := uint32(first & 0x0f)
+		for i := 0; i < 3; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, err
+			}
+			value = value<<8 | uint32(b)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		return int32(value<<4 | uint32(b&0x0f)), nil
+	}
+
+	value := uint32(first & (0xff >> uint(count+1)))
+	for i := 0; i < count; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | uint32(b)
+	}
+	return int32(value), nil
+}
+
+// readLTF8 reads a single LTF8 encoded integer from r, as described in section
+// 2.3 of the CRAM specification.
+func readLTF8(r io.ByteReader) (int64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for mask := byte(0x80); count < 8 && first&mask != 0; mask >>= 1 {
+		count++
+	}
+
+	var value uint64
+	if count < 7 {
+		value = uint64(first & (0xff >> uint(count+1)))
+	}
+	for i := 0; i < count; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value = value<<8 | uint64(b)
+	}
+	return int64(value), nil
+}
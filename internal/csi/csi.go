@@ -16,58 +16,438 @@
 package csi
 
 import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
 	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
-// RegionContainsBin indicates if the given region contains the bin described by
-// referenceID and binID.
-func RegionContainsBin(region genomics.Region, referenceID int32, binID uint32, bins []uint16) bool {
-	if region.ReferenceID >= 0 && referenceID != region.ReferenceID {
-		return false
+const (
+	csiMagic = "CSI\x01"
+
+	// The BAI and tabix formats use a fixed 6 level (depth = 5) binning scheme
+	// with a minimum width of 14 bits.
+	linearMinShift = 14
+	linearDepth    = 5
+
+	// The deepest binning scheme for which every bin ID fits in 32 bits.
+	maximumDepth = 10
+
+	// The size of each tiling window from the linear index, as specified in the
+	// SAM specification section 5.1.3.
+	linearWindowSize = 1 << linearMinShift
+
+	// This is just to prevent arbitrarily large allocations due to malformed
+	// data.
+	maximumAuxLength = 1 << 20
+)
+
+// Index holds the contents of a CSI file so that it can be queried
+// repeatedly without being parsed again.
+type Index struct {
+	minShift, depth int32
+	references      []reference
+	headerEnd       bgzf.Address
+	mappedEnd       bgzf.Address
+	unplaced        *uint64
+	boundaries      []bgzf.Address
+}
+
+type reference struct {
+	bins []bin
+
+	// Each bin records the offset of the first record that overlaps it.
+	offsets map[uint32]bgzf.Address
+}
+
+type bin struct {
+	id     uint32
+	chunks []bgzf.Chunk
+}
+
+// ReadIndex reads and parses the BGZF compressed CSI file csi.
+func ReadIndex(csi io.Reader) (*Index, error) {
+	gzr, err := gzip.NewReader(csi)
+	if err != nil {
+		return nil, fmt.Errorf("initializing gzip reader: %v", err)
 	}
+	defer gzr.Close()
 
-	if region.Start == 0 && region.End == 0 {
-		return true
+	if err := binary.ExpectBytes(gzr, []byte(csiMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var header struct {
+		MinShift, Depth, AuxLength int32
+	}
+	if err := binary.Read(gzr, &header); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	// Bin IDs must fit in 32 bits and the width of each bin in 64 bits.
+	if header.MinShift < 0 || header.Depth < 0 || header.Depth > maximumDepth || header.MinShift+3*header.Depth > 63 {
+		return nil, fmt.Errorf("unsupported binning scheme (min_shift %d, depth %d)", header.MinShift, header.Depth)
+	}
+	if header.AuxLength < 0 || header.AuxLength > maximumAuxLength {
+		return nil, fmt.Errorf("invalid auxiliary data length (%d bytes)", header.AuxLength)
+	}
+	if _, err := io.CopyN(ioutil.Discard, gzr, int64(header.AuxLength)); err != nil {
+		return nil, fmt.Errorf("reading past auxiliary data: %v", err)
+	}
+
+	var references int32
+	if err := binary.Read(gzr, &references); err != nil {
+		return nil, fmt.Errorf("reading reference count: %v", err)
 	}
 
-	for _, id := range bins {
-		if uint32(id) == binID {
-			return true
+	metadataID := binLimit(header.Depth) + 1
+	index := &Index{
+		minShift:  header.MinShift,
+		depth:     header.Depth,
+		headerEnd: bgzf.LastAddress,
+	}
+	for i := int32(0); i < references; i++ {
+		var binCount int32
+		if err := binary.Read(gzr, &binCount); err != nil {
+			return nil, fmt.Errorf("reading bin count: %v", err)
+		}
+		reference := reference{offsets: make(map[uint32]bgzf.Address)}
+		for j := int32(0); j < binCount; j++ {
+			var header struct {
+				ID     uint32
+				Offset bgzf.Address
+				Chunks int32
+			}
+			if err := binary.Read(gzr, &header); err != nil {
+				return nil, fmt.Errorf("reading bin header: %v", err)
+			}
+			reference.offsets[header.ID] = header.Offset
+
+			bin := bin{id: header.ID}
+			for k := int32(0); k < header.Chunks; k++ {
+				var chunk bgzf.Chunk
+				if err := binary.Read(gzr, &chunk); err != nil {
+					return nil, fmt.Errorf("reading chunk: %v", err)
+				}
+				if header.ID == metadataID {
+					continue
+				}
+				bin.chunks = append(bin.chunks, chunk)
+				if index.headerEnd > chunk.Start {
+					index.headerEnd = chunk.Start
+				}
+				if index.mappedEnd < chunk.End {
+					index.mappedEnd = chunk.End
+				}
+			}
+			if len(bin.chunks) > 0 {
+				reference.bins = append(reference.bins, bin)
+			}
 		}
+		index.references = append(index.references, reference)
+	}
+	if index.unplaced, err = readUnplacedCount(gzr); err != nil {
+		return nil, err
 	}
-	return false
+
+	var addresses []bgzf.Address
+	for _, reference := range index.references {
+		for _, bin := range reference.bins {
+			for _, chunk := range bin.chunks {
+				addresses = append(addresses, chunk.Start, chunk.End)
+			}
+		}
+		for _, offset := range reference.offsets {
+			addresses = append(addresses, offset)
+		}
+	}
+	index.boundaries = sortAddresses(addresses)
+	return index, nil
 }
 
-// BinsForRange returns the list of bins that may overlap with the zero-based region
-// defined by [start, end). The minShift and depth parameters control the minimum interval width
-// and number of binning levels, respectively.
-func BinsForRange(start, end uint32, minShift, depth int32) []uint16 {
-	maxWidth := maximumBinWidth(minShift, depth)
-	if end == 0 || end > maxWidth {
-		end = maxWidth
+// Boundaries returns the sorted addresses of the records that start chunks in
+// the index or are recorded as the first record in a bin.  Since records
+// start at each of them, they can be used to split chunks into smaller parts.
+func (index *Index) Boundaries() []bgzf.Address {
+	return index.boundaries
+}
+
+// Query returns a set of BGZF chunks covering the header and all records that
+// fall inside the specified region.  The first chunk is always the header.
+// The returned chunks are newly allocated and may be modified by the caller.
+func (index *Index) Query(region genomics.Region) []*bgzf.Chunk {
+	leafID := firstBinID(index.depth) + region.Start>>uint32(index.minShift)
+
+	chunks := []*bgzf.Chunk{{End: index.headerEnd}}
+	if region.ReferenceID == genomics.UnmappedReferenceID {
+		return append(chunks, unmappedChunks(index.mappedEnd, index.unplaced)...)
 	}
-	if end <= start {
-		return nil
+	for i, reference := range index.references {
+		// The closest available ancestor of the leaf bin containing the start of
+		// the region bounds the chunks that need to be considered.
+		var firstRecordOffset bgzf.Address
+		for id := leafID; ; id = (id - 1) >> 3 {
+			if offset, ok := reference.offsets[id]; ok {
+				firstRecordOffset = offset
+				break
+			}
+			if id == 0 {
+				break
+			}
+		}
+
+		for _, bin := range reference.bins {
+			if !RegionContainsBin(region, int32(i), bin.id, index.minShift, index.depth) {
+				continue
+			}
+			for _, chunk := range bin.chunks {
+				if chunk.End < firstRecordOffset {
+					continue
+				}
+				chunk := chunk
+				chunks = append(chunks, &chunk)
+			}
+		}
 	}
-	if start > maxWidth {
+	return chunks
+}
+
+// LinearIndex holds the binning and linear index data of a BAI or tabix file,
+// which are both fixed instances of the CSI binning scheme that use a linear
+// index instead of per-bin offsets.  It is parsed once and can then be queried
+// repeatedly.
+type LinearIndex struct {
+	references []linearReference
+	headerEnd  bgzf.Address
+	mappedEnd  bgzf.Address
+	unplaced   *uint64
+	boundaries []bgzf.Address
+}
+
+type linearReference struct {
+	bins    []linearBin
+	offsets []uint64
+}
+
+type linearBin struct {
+	id     uint32
+	chunks []bgzf.Chunk
+}
+
+// ParseLinearIndex reads the per-reference binning and linear index data for
+// references from r, followed by the optional count of unplaced unmapped
+// reads.
+func ParseLinearIndex(r io.Reader, references int32) (*LinearIndex, error) {
+	metadataID := binLimit(linearDepth) + 1
+
+	index := &LinearIndex{headerEnd: bgzf.LastAddress}
+	for i := int32(0); i < references; i++ {
+		var reference linearReference
+		var binCount int32
+		if err := binary.Read(r, &binCount); err != nil {
+			return nil, fmt.Errorf("reading bin count: %v", err)
+		}
+		for j := int32(0); j < binCount; j++ {
+			var header struct {
+				ID     uint32
+				Chunks int32
+			}
+			if err := binary.Read(r, &header); err != nil {
+				return nil, fmt.Errorf("reading bin header: %v", err)
+			}
+
+			bin := linearBin{id: header.ID}
+			for k := int32(0); k < header.Chunks; k++ {
+				var chunk bgzf.Chunk
+				if err := binary.Read(r, &chunk); err != nil {
+					return nil, fmt.Errorf("reading chunk: %v", err)
+				}
+				if header.ID == metadataID {
+					continue
+				}
+				bin.chunks = append(bin.chunks, chunk)
+				if index.headerEnd > chunk.Start {
+					index.headerEnd = chunk.Start
+				}
+				if index.mappedEnd < chunk.End {
+					index.mappedEnd = chunk.End
+				}
+			}
+			if len(bin.chunks) > 0 {
+				reference.bins = append(reference.bins, bin)
+			}
+		}
+
+		var intervals int32
+		if err := binary.Read(r, &intervals); err != nil {
+			return nil, fmt.Errorf("reading interval count: %v", err)
+		}
+		if intervals < 0 {
+			return nil, fmt.Errorf("invalid interval count (%d intervals)", intervals)
+		}
+		reference.offsets = make([]uint64, intervals)
+		if err := binary.Read(r, &reference.offsets); err != nil {
+			return nil, fmt.Errorf("reading offsets: %v", err)
+		}
+		index.references = append(index.references, reference)
+	}
+	unplaced, err := readUnplacedCount(r)
+	if err != nil {
+		return nil, err
+	}
+	index.unplaced = unplaced
+
+	var addresses []bgzf.Address
+	for _, reference := range index.references {
+		for _, bin := range reference.bins {
+			for _, chunk := range bin.chunks {
+				addresses = append(addresses, chunk.Start, chunk.End)
+			}
+		}
+		for _, offset := range reference.offsets {
+			addresses = append(addresses, bgzf.Address(offset))
+		}
+	}
+	index.boundaries = sortAddresses(addresses)
+	return index, nil
+}
+
+// Boundaries returns the sorted addresses of the records that start chunks in
+// the index or are recorded in the linear index.  Since records start at each
+// of them, they can be used to split chunks into smaller parts.
+func (index *LinearIndex) Boundaries() []bgzf.Address {
+	return index.boundaries
+}
+
+// Query returns a set of BGZF chunks covering the header and all records that
+// fall inside the specified region.  The first chunk is always the header.
+// The returned chunks are newly allocated and may be modified by the caller.
+func (index *LinearIndex) Query(region genomics.Region) []*bgzf.Chunk {
+	chunks := []*bgzf.Chunk{{End: index.headerEnd}}
+	if region.ReferenceID == genomics.UnmappedReferenceID {
+		return append(chunks, unmappedChunks(index.mappedEnd, index.unplaced)...)
+	}
+	for i, reference := range index.references {
+		var firstReadOffset bgzf.Address
+		if n := int(region.Start / linearWindowSize); n < len(reference.offsets) {
+			firstReadOffset = bgzf.Address(reference.offsets[n])
+		}
+
+		for _, bin := range reference.bins {
+			if !RegionContainsBin(region, int32(i), bin.id, linearMinShift, linearDepth) {
+				continue
+			}
+			for _, chunk := range bin.chunks {
+				if chunk.End < firstReadOffset {
+					continue
+				}
+				chunk := chunk
+				chunks = append(chunks, &chunk)
+			}
+		}
+	}
+	return chunks
+}
+
+// readUnplacedCount reads the number of unplaced unmapped reads that may
+// follow the index data, or returns nil if it is not present.
+func readUnplacedCount(r io.Reader) (*uint64, error) {
+	var count uint64
+	switch err := binary.Read(r, &count); err {
+	case nil:
+		return &count, nil
+	case io.EOF:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("reading unplaced unmapped read count: %v", err)
+	}
+}
+
+// sortAddresses sorts addresses and removes any duplicates, along with zero
+// addresses, which are used to mark empty entries.
+func sortAddresses(addresses []bgzf.Address) []bgzf.Address {
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i] < addresses[j]
+	})
+	var sorted []bgzf.Address
+	for _, address := range addresses {
+		if address != 0 && (len(sorted) == 0 || sorted[len(sorted)-1] != address) {
+			sorted = append(sorted, address)
+		}
+	}
+	return sorted
+}
+
+// unmappedChunks returns the chunks that cover the unplaced unmapped reads,
+// which follow the last of the mapped reads at mappedEnd.  The end of the data
+// is not recorded in the index, so the chunk ends at bgzf.LastAddress.  No
+// chunks are returned if the index records that there are no unplaced
+// unmapped reads, or if there are no mapped reads, in which case the header
+// chunk already covers all of the data.
+func unmappedChunks(mappedEnd bgzf.Address, unplaced *uint64) []*bgzf.Chunk {
+	if mappedEnd == 0 || unplaced != nil && *unplaced == 0 {
 		return nil
 	}
+	return []*bgzf.Chunk{{Start: mappedEnd, End: bgzf.LastAddress}}
+}
 
-	// This is derived from the C examples in the CSI index specification.
-	end--
-	var bins []uint16
-	for l, t, s := uint(0), uint(0), uint(minShift+depth*3); l <= uint(depth); l++ {
-		b := t + (uint(start) >> s)
-		e := t + (uint(end) >> s)
-		for i := b; i <= e; i++ {
-			bins = append(bins, uint16(i))
+// RegionContainsBin indicates if the given region overlaps the bin described
+// by referenceID and binID in a binning scheme with the given minShift and
+// depth.
+func RegionContainsBin(region genomics.Region, referenceID int32, binID uint32, minShift, depth int32) bool {
+	if region.ReferenceID >= 0 && referenceID != region.ReferenceID {
+		return false
+	}
+
+	if region.Start == 0 && region.End == 0 {
+		return true
+	}
+
+	start, end := uint64(region.Start), uint64(region.End)
+	if maxWidth := maximumBinWidth(minShift, depth); end == 0 || end > maxWidth {
+		end = maxWidth
+	}
+	if end <= start {
+		return false
+	}
+	binStart, binEnd, ok := binRange(binID, minShift, depth)
+	return ok && start < binEnd && binStart < end
+}
+
+// binRange returns the zero-based interval [start, end) covered by the bin
+// with the given ID, or false if there is no such bin.  The minShift and depth
+// parameters control the minimum interval width and number of binning levels,
+// respectively.
+func binRange(id uint32, minShift, depth int32) (uint64, uint64, bool) {
+	var first uint32
+	for level := int32(0); level <= depth; level++ {
+		count := uint32(1) << uint32(level*3)
+		if id-first < count {
+			width := uint64(1) << uint32(minShift+(depth-level)*3)
+			start := uint64(id-first) * width
+			return start, start + width, true
 		}
-		s -= 3
-		t += 1 << (l * 3)
+		first += count
 	}
-	return bins
+	return 0, 0, false
+}
+
+func maximumBinWidth(minShift, depth int32) uint64 {
+	return uint64(1) << uint32(minShift+depth*3)
+}
+
+// firstBinID returns the ID of the first bin at the deepest level of a binning
+// scheme with the given depth.
+func firstBinID(depth int32) uint32 {
+	return uint32((1<<uint32(depth*3) - 1) / 7)
 }
 
-func maximumBinWidth(minShift, depth int32) uint32 {
-	return uint32(1 << uint32(minShift+depth*3))
+// binLimit returns the largest valid bin ID for a binning scheme with the
+// given depth.  The next ID is reserved for the metadata pseudo-bin.
+func binLimit(depth int32) uint32 {
+	return uint32((1<<uint32((depth+1)*3) - 1) / 7)
 }
@@ -18,36 +18,93 @@ import (
 	"testing"
 
 	"math"
+	"os"
 	"reflect"
+
+	"github.com/googlegenomics/htsget/internal/genomics"
 )
 
-func TestBinsForRange(t *testing.T) {
+func TestRegionContainsBin(t *testing.T) {
 	metadataID := 37450
-	allBins := make([]uint16, metadataID-1)
+	allBins := make([]uint32, metadataID-1)
 	for i := range allBins {
-		allBins[i] = uint16(i)
+		allBins[i] = uint32(i)
 	}
 
 	testCases := []struct {
 		name            string
 		start, end      uint32
 		minShift, depth int32
-		bins            []uint16
+		bins            []uint32
 	}{
 		{"end clamping", 0, math.MaxUint32, 14, 5, allBins},
-		{"end past maximum", 0, maximumBinWidth(14, 5) + 1, 14, 5, allBins},
-		{"start past maximum", maximumBinWidth(14, 5) + 1, maximumBinWidth(14, 5) + 2, 14, 5, nil},
-		{"narrow region", 0, 1, 14, 5, []uint16{0, 1, 9, 73, 585, 4681}},
-		{"narrow depth", 0, 1, 14, 4, []uint16{0, 1, 9, 73, 585}},
+		{"end past maximum", 0, uint32(maximumBinWidth(14, 5)) + 1, 14, 5, allBins},
+		{"start past maximum", uint32(maximumBinWidth(14, 5)) + 1, uint32(maximumBinWidth(14, 5)) + 2, 14, 5, nil},
+		{"narrow region", 0, 1, 14, 5, []uint32{0, 1, 9, 73, 585, 4681}},
+		{"narrow depth", 0, 1, 14, 4, []uint32{0, 1, 9, 73, 585}},
 		{"invalid range (start > end)", math.MaxUint32, 0, 14, 5, nil},
 		{"swapped endpoints", 2, 1, 14, 5, nil},
 		{"zero-width region", 1, 1, 14, 5, nil},
 		{"zero end", 1, 0, 14, 5, allBins},
+		{"deep scheme", 600000000, 600000001, 14, 6, []uint32{0, 2, 17, 144, 1157, 9258, 74070}},
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			if got, want := BinsForRange(tc.start, tc.end, tc.minShift, tc.depth), tc.bins; !reflect.DeepEqual(got, want) {
-				t.Fatalf("BinsForRange(%v, %v) = %+v, want %+v", tc.start, tc.end, got, want)
+			region := genomics.Region{Start: tc.start, End: tc.end}
+			var got []uint32
+			for id := uint32(0); id <= binLimit(tc.depth); id++ {
+				if RegionContainsBin(region, 0, id, tc.minShift, tc.depth) {
+					got = append(got, id)
+				}
+			}
+			if want := tc.bins; !reflect.DeepEqual(got, want) {
+				t.Fatalf("RegionContainsBin(%v, %v) matched %+v, want %+v", tc.start, tc.end, got, want)
+			}
+		})
+	}
+}
+
+func TestIndex_QueryRegion(t *testing.T) {
+	testCases := []struct {
+		filename string
+		name     string
+		region   genomics.Region
+		chunks   int
+	}{
+		{"sample.bcf.csi", "all records", genomics.AllMappedReads, 378},
+		{"sample.bcf.csi", "reference Y, all records", genomics.Region{ReferenceID: 2}, 4},
+		{"sample.bcf.csi", "reference 20, some records", genomics.Region{
+			ReferenceID: 1,
+			Start:       1000000,
+			End:         1100000,
+		}, 8},
+		{"sample.bcf.csi", "reference 20, past last record", genomics.Region{
+			ReferenceID: 1,
+			Start:       10000000,
+		}, 1},
+		{"csi.vcf.gz.csi", "all records", genomics.AllMappedReads, 373},
+		{"csi.vcf.gz.csi", "reference 20, some records", genomics.Region{
+			ReferenceID: 1,
+			Start:       1000000,
+			End:         1100000,
+		}, 8},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.filename+"/"+tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/" + tc.filename)
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			index, err := ReadIndex(r)
+			if err != nil {
+				t.Fatalf("Failed to read test data: %v", err)
+			}
+			chunks := index.Query(tc.region)
+			if got, want := len(chunks), tc.chunks; got != want {
+				t.Fatalf("Wrong number of chunks: got %d, want %d", got, want)
 			}
 		})
 	}
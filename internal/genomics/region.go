@@ -6,10 +6,19 @@ import "fmt"
 // AllMappedReads defines a Region that matches all mapped reads.
 var AllMappedReads = Region{ReferenceID: -1}
 
+// UnmappedReferenceID is the reference ID of the Region that matches the
+// unplaced unmapped reads, which have no reference and are stored after all of
+// the other reads in coordinate sorted files.
+const UnmappedReferenceID = -2
+
+// UnmappedReads defines a Region that matches the unplaced unmapped reads.
+var UnmappedReads = Region{ReferenceID: UnmappedReferenceID}
+
 // Region defines a region of genomic interest.
 type Region struct {
-	// ReferenceID specifies the reference to match.  If it is negative, any
-	// reference matches the region.
+	// ReferenceID specifies the reference to match.  If it is
+	// UnmappedReferenceID, only unplaced unmapped reads match the region.
+	// Otherwise, if it is negative, any reference matches the region.
 	ReferenceID int32
 	// Start and End specify the open range (in base pairs) relative to the
 	// reference.  If End is zero, it is treated as though it was set to the last
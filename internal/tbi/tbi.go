@@ -0,0 +1,188 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tbi provides support for parsing tabix index files
+// (http://samtools.github.io/hts-specs/tabix.pdf).
+package tbi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/binary"
+	"github.com/googlegenomics/htsget/internal/csi"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+const (
+	tbiMagic = "TBI\x01"
+
+	// This is just to prevent arbitrarily large allocations due to malformed
+	// data.
+	maximumNamesLength = 1 << 24
+
+	// Positions in files with this format flag are zero-based and half-open,
+	// as in BED files.
+	zeroBasedFlag = 0x10000
+)
+
+// The types of data that can be indexed using tabix.
+const (
+	FormatGeneric = 0
+	FormatSAM     = 1
+	FormatVCF     = 2
+)
+
+// Header describes how the lines of a file indexed using tabix are
+// interpreted.
+type Header struct {
+	// Format is the type of the data (FormatGeneric, FormatSAM or FormatVCF).
+	Format int32
+
+	// ZeroBased is true if positions in the data are zero-based and half-open
+	// rather than one-based and closed.
+	ZeroBased bool
+
+	// SequenceColumn, BeginColumn and EndColumn are the one-based columns that
+	// hold the name of the reference and the start and end of each record.  If
+	// EndColumn is zero, records end at their start position.
+	SequenceColumn, BeginColumn, EndColumn int32
+
+	// Meta is the character that starts header lines, such as '#'.
+	Meta byte
+
+	// Skip is the number of lines at the start of the data that are skipped.
+	Skip int32
+
+	// Names lists the names of the references in order of their IDs.
+	Names []string
+}
+
+// ReferenceID returns the ID of the named reference.
+func (header *Header) ReferenceID(reference string) (int32, error) {
+	for i, name := range header.Names {
+		if name == reference {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("no reference named %q found", reference)
+}
+
+// ReadHeader reads the header of the BGZF compressed tabix index tbi.
+func ReadHeader(tbi io.Reader) (*Header, error) {
+	gzr, err := gzip.NewReader(tbi)
+	if err != nil {
+		return nil, fmt.Errorf("initializing gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	return readHeader(gzr)
+}
+
+// GetReferenceID returns the ID of the named reference from the sequence
+// names stored in the BGZF compressed tabix index tbi.
+func GetReferenceID(tbi io.Reader, reference string) (int32, error) {
+	header, err := ReadHeader(tbi)
+	if err != nil {
+		return 0, err
+	}
+	return header.ReferenceID(reference)
+}
+
+// Index holds the contents of a tabix index so that it can be queried
+// repeatedly without being parsed again.
+type Index struct {
+	Header
+	index *csi.LinearIndex
+}
+
+// ReadIndex reads and parses the BGZF compressed tabix index tbi.
+func ReadIndex(tbi io.Reader) (*Index, error) {
+	gzr, err := gzip.NewReader(tbi)
+	if err != nil {
+		return nil, fmt.Errorf("initializing gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	header, err := readHeader(gzr)
+	if err != nil {
+		return nil, err
+	}
+	index, err := csi.ParseLinearIndex(gzr, int32(len(header.Names)))
+	if err != nil {
+		return nil, err
+	}
+	return &Index{*header, index}, nil
+}
+
+// Query returns a set of BGZF chunks covering the header and all records that
+// fall inside the specified region.  The first chunk is always the header.
+// The returned chunks may be modified by the caller.
+func (index *Index) Query(region genomics.Region) []*bgzf.Chunk {
+	return index.index.Query(region)
+}
+
+// Boundaries returns the sorted addresses at which records are known to
+// start, which can be used to split chunks using bgzf.Split.
+func (index *Index) Boundaries() []bgzf.Address {
+	return index.index.Boundaries()
+}
+
+func readHeader(r io.Reader) (*Header, error) {
+	if err := binary.ExpectBytes(r, []byte(tbiMagic)); err != nil {
+		return nil, fmt.Errorf("reading magic: %v", err)
+	}
+
+	var header struct {
+		References           int32
+		Format               int32
+		Sequence, Begin, End int32
+		Meta                 int32
+		Skip                 int32
+		NamesLength          int32
+	}
+	if err := binary.Read(r, &header); err != nil {
+		return nil, fmt.Errorf("reading header: %v", err)
+	}
+	if header.NamesLength < 0 || header.NamesLength > maximumNamesLength {
+		return nil, fmt.Errorf("invalid names length (%d bytes)", header.NamesLength)
+	}
+
+	buffer := make([]byte, header.NamesLength)
+	if _, err := io.ReadFull(r, buffer); err != nil {
+		return nil, fmt.Errorf("reading names: %v", err)
+	}
+	var names []string
+	for _, name := range bytes.Split(buffer, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	if int32(len(names)) != header.References {
+		return nil, fmt.Errorf("found %d names for %d references", len(names), header.References)
+	}
+	return &Header{
+		Format:         header.Format &^ zeroBasedFlag,
+		ZeroBased:      header.Format&zeroBasedFlag != 0,
+		SequenceColumn: header.Sequence,
+		BeginColumn:    header.Begin,
+		EndColumn:      header.End,
+		Meta:           byte(header.Meta),
+		Skip:           header.Skip,
+		Names:          names,
+	}, nil
+}
@@ -0,0 +1,194 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package tbi
+
+import (
+	"bytes"
+	encoding "encoding/binary"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/googlegenomics/htsget/internal/bgzf"
+	"github.com/googlegenomics/htsget/internal/genomics"
+)
+
+func TestGetReferenceID(t *testing.T) {
+	testCases := []struct {
+		name string
+		id   int32
+		err  bool
+	}{
+		{"19", 0, false},
+		{"20", 1, false},
+		{"Y", 2, false},
+		{"X", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/sample.vcf.gz.tbi")
+			if err != nil {
+				t.Fatalf("Failed to open testdata: %v", err)
+			}
+			defer r.Close()
+
+			id, err := GetReferenceID(r, tc.name)
+			if (err != nil) != tc.err {
+				t.Fatalf("GetReferenceID() returned unexpected error: %v", err)
+			}
+			if id != tc.id {
+				t.Fatalf("Wrong reference ID: got %d, want %d", id, tc.id)
+			}
+		})
+	}
+}
+
+func TestIndex_QueryRegion(t *testing.T) {
+	testCases := []struct {
+		name   string
+		region genomics.Region
+		chunks int
+	}{
+		{"all records", genomics.AllMappedReads, 373},
+		{"reference 19, all records", genomics.Region{ReferenceID: 0}, 185},
+		{"reference Y, all records", genomics.Region{ReferenceID: 2}, 3},
+		{"reference 20, some records", genomics.Region{
+			ReferenceID: 1,
+			Start:       1000000,
+			End:         1100000,
+		}, 8},
+		{"reference 20, zero end", genomics.Region{
+			ReferenceID: 1,
+			Start:       2500000,
+		}, 37},
+		{"reference 20, past last record", genomics.Region{
+			ReferenceID: 1,
+			Start:       10000000,
+		}, 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/sample.vcf.gz.tbi")
+			if err != nil {
+				t.Fatalf("Failed to open test data: %v", err)
+			}
+			defer r.Close()
+
+			index, err := ReadIndex(r)
+			if err != nil {
+				t.Fatalf("Failed to read test data: %v", err)
+			}
+			chunks := index.Query(tc.region)
+			if got, want := len(chunks), tc.chunks; got != want {
+				t.Fatalf("Wrong number of chunks: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	vcf, err := ioutil.ReadFile("testdata/sample.vcf.gz.tbi")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+
+	// A tabix index of a BED file with two references and no records.
+	var buf bytes.Buffer
+	buf.WriteString("TBI\x01")
+	for _, v := range []int32{2, FormatGeneric | zeroBasedFlag, 1, 2, 3, '#', 1, 8} {
+		if err := encoding.Write(&buf, encoding.LittleEndian, v); err != nil {
+			t.Fatalf("Failed to write test data: %v", err)
+		}
+	}
+	buf.WriteString("chr1\x00ch2\x00")
+	bed, err := bgzf.EncodeBlock(buf.Bytes())
+	if err != nil {
+		t.Fatalf("EncodeBlock() failed: %v", err)
+	}
+
+	testCases := []struct {
+		name   string
+		data   []byte
+		header *Header
+	}{
+		{"VCF", vcf, &Header{
+			Format:         FormatVCF,
+			SequenceColumn: 1,
+			BeginColumn:    2,
+			Meta:           '#',
+			Names:          []string{"19", "20", "Y"},
+		}},
+		{"BED", bed, &Header{
+			Format:         FormatGeneric,
+			ZeroBased:      true,
+			SequenceColumn: 1,
+			BeginColumn:    2,
+			EndColumn:      3,
+			Meta:           '#',
+			Skip:           1,
+			Names:          []string{"chr1", "ch2"},
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			header, err := ReadHeader(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatalf("ReadHeader() failed: %v", err)
+			}
+			if got, want := header, tc.header; !reflect.DeepEqual(got, want) {
+				t.Errorf("Wrong header: got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestIndex_Query(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/sample.vcf.gz.tbi")
+	if err != nil {
+		t.Fatalf("Failed to read test data: %v", err)
+	}
+	index, err := ReadIndex(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse test data: %v", err)
+	}
+
+	id, err := index.ReferenceID("20")
+	if err != nil {
+		t.Fatalf("ReferenceID() failed: %v", err)
+	}
+	for _, region := range []genomics.Region{
+		genomics.AllMappedReads,
+		{ReferenceID: id, Start: 1000000, End: 1100000},
+		{ReferenceID: id, Start: 1000000, End: 1100000},
+	} {
+		// The results must match those of a freshly parsed index.
+		fresh, err := ReadIndex(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to parse test data: %v", err)
+		}
+		want := fresh.Query(region)
+		got := index.Query(region)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Query(%s): got %v, want %v", region, got, want)
+		}
+
+		// Modifying the results must not affect later queries.
+		for _, chunk := range got {
+			chunk.End = bgzf.LastAddress
+		}
+	}
+}
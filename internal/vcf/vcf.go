@@ -0,0 +1,92 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package vcf contains support for parsing VCF files.
+package vcf
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// GetReferenceID retrieves the reference id of the given referenceName from
+// the provided bgzipped vcf file.
+func GetReferenceID(vcf io.Reader, referenceName string) (int, error) {
+	gzr, err := gzip.NewReader(vcf)
+	if err != nil {
+		return 0, fmt.Errorf("initializing gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	return ReferenceIDFromHeader(gzr, referenceName)
+}
+
+// ReferenceIDFromHeader retrieves the reference id of the given referenceName
+// from the contig lines in the uncompressed VCF header text read from r.  The
+// id is taken from the IDX field if present, otherwise it is the index of the
+// contig line in the header.
+func ReferenceIDFromHeader(r io.Reader, referenceName string) (int, error) {
+	scanner := bufio.NewScanner(r)
+	var id int
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "##contig") {
+			if contigField(line, "ID") == referenceName {
+				return resolveID(line, id)
+			}
+			id++
+		} else if id > 0 || !strings.HasPrefix(line, "##") {
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("scanning header: %v", err)
+	}
+	return 0, errors.New("reference name not found")
+}
+
+func contigField(input, name string) string {
+	field := name + "="
+	for {
+		start := strings.Index(input, field)
+		if start == -1 {
+			return ""
+		}
+		skip := start > 0 && !isDelimiter(input[start-1])
+		input = input[start+len(field):]
+		if skip {
+			continue
+		}
+		if end := strings.IndexAny(input, ",>"); end > 0 {
+			return input[:end]
+		}
+		return input
+	}
+}
+
+func isDelimiter(chr byte) bool {
+	return chr == ',' || chr == '<'
+}
+
+func resolveID(contig string, id int) (int, error) {
+	if idx := contigField(contig, "IDX"); idx != "" {
+		return strconv.Atoi(idx)
+	}
+	return id, nil
+}
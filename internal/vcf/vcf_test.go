@@ -0,0 +1,104 @@
+// Copyright 2018 Google Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package vcf
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGetReferenceID(t *testing.T) {
+	testCases := []struct {
+		name string
+		id   int
+		err  bool
+	}{
+		{"19", 0, false},
+		{"20", 1, false},
+		{"Y", 2, false},
+		{"Z", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, err := os.Open("testdata/sample.vcf.gz")
+			if err != nil {
+				t.Fatalf("Failed to open testdata: %v", err)
+			}
+			defer r.Close()
+
+			id, err := GetReferenceID(r, tc.name)
+			if (err != nil) != tc.err {
+				t.Fatalf("GetReferenceID() returned unexpected error: %v", err)
+			}
+			if id != tc.id {
+				t.Fatalf("Wrong reference ID: got %d, want %d", id, tc.id)
+			}
+		})
+	}
+}
+
+func TestReferenceIDFromHeader_StopsAtColumnHeader(t *testing.T) {
+	header := "##fileformat=VCFv4.2\n#CHROM\tPOS\n##contig=<ID=1>\n"
+	if _, err := ReferenceIDFromHeader(strings.NewReader(header), "1"); err == nil {
+		t.Fatal("ReferenceIDFromHeader() found a contig line after the column header")
+	}
+}
+
+func TestContigField(t *testing.T) {
+	testCases := []struct {
+		contig string
+		field  string
+		want   string
+	}{
+		{"##contig=<ID=chr1,length=248956422,IDX=0>", "ID", "chr1"},
+		{"##contig=<ID=chr10,length=248956422,IDX=0>", "length", "248956422"},
+		{"##contig=<ID=Y,length=248956422,IDX=0>", "IDX", "0"},
+		{"##contig=<length=248956422,IDX=0>", "OTHER", ""},
+		{"##contig=<ID=IDX,length=248956422,IDX=7>", "IDX", "7"},
+		{"##contig=<BADIDX=NO,length=248956422,IDX=7>", "IDX", "7"},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			if got := contigField(tc.contig, tc.field); got != tc.want {
+				t.Fatalf("Wrong contigField response, want %v, got %v ", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestResolveID(t *testing.T) {
+	testCases := []struct {
+		line string
+		want int
+	}{
+		{"##contig=<ID=chr1,length=248956422>", -1},
+		{"##contig=<ID=chr1,length=248956422,IDX=0>", 0},
+		{"##contig=<ID=chr1,length=248956422,IDX=7>", 7},
+		{"##contig=<ID=chr1,length=248956422,IDX=125>", 125},
+		{"##contig=<ID=chr1,IDX=125,length=248956422>", 125},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			if got, _ := resolveID(tc.line, -1); got != tc.want {
+				t.Fatalf("Wrong getIdx response, want %d, got %d ", tc.want, got)
+			}
+		})
+	}
+}